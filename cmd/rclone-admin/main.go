@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/PlakarKorp/integration-rclone/storage"
+	kstorage "github.com/PlakarKorp/kloset/storage"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s <command> [options] key=value...\n\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "The key=value pairs are the store configuration, as shown by `plakar store show`.\n\n")
+	fmt.Fprintf(os.Stderr, "commands:\n")
+	fmt.Fprintf(os.Stderr, "  check [-repair]                  audit the repository objects and print a JSON report\n")
+	fmt.Fprintf(os.Stderr, "  migrate -layout <flat|sharded>   convert the repository to another layout\n")
+	fmt.Fprintf(os.Stderr, "  transfer [-concurrency n]         copy the repository from the src.* remote to the dst.* remote\n")
+	fmt.Fprintf(os.Stderr, "  resync                           copy the objects missing on a replica from the other remotes\n")
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	var err error
+	switch os.Args[1] {
+	case "check":
+		err = check(ctx, os.Args[2:])
+	case "migrate":
+		err = migrate(ctx, os.Args[2:])
+	case "transfer":
+		err = transfer(ctx, os.Args[2:])
+	case "resync":
+		err = resync(ctx, os.Args[2:])
+	default:
+		usage()
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", os.Args[0], err)
+		os.Exit(1)
+	}
+}
+
+func migrate(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	layout := flags.String("layout", "", "target layout: flat or sharded")
+	flags.Parse(args)
+
+	store, err := openStore(ctx, flags.Args())
+	if err != nil {
+		return err
+	}
+	defer store.Close(ctx)
+
+	for _, remote := range remotes(store) {
+		if err := remote.Migrate(ctx, *layout); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func check(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	repair := flags.Bool("repair", false, "move faulty objects to their place or to the quarantine folder")
+	flags.Parse(args)
+
+	store, err := openStore(ctx, flags.Args())
+	if err != nil {
+		return err
+	}
+	defer store.Close(ctx)
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+
+	unrepaired := 0
+	for _, remote := range remotes(store) {
+		report, err := remote.Check(ctx, *repair)
+		if err != nil {
+			return err
+		}
+
+		if err := enc.Encode(report); err != nil {
+			return err
+		}
+
+		for _, issue := range report.Issues {
+			if !issue.Repaired {
+				unrepaired++
+			}
+		}
+	}
+	if unrepaired != 0 {
+		return fmt.Errorf("%d issue(s) found in the repository", unrepaired)
+	}
+	return nil
+}
+
+func resync(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("resync", flag.ExitOnError)
+	flags.Parse(args)
+
+	store, err := openStore(ctx, flags.Args())
+	if err != nil {
+		return err
+	}
+	defer store.Close(ctx)
+
+	replicated, ok := store.(*storage.ReplicatedStorage)
+	if !ok {
+		return fmt.Errorf("the store has no replica")
+	}
+
+	report, err := replicated.Resync(ctx)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		return err
+	}
+
+	if len(report.Failed) != 0 {
+		return fmt.Errorf("%d object(s) could not be copied", len(report.Failed))
+	}
+	return nil
+}
+
+func transfer(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("transfer", flag.ExitOnError)
+	concurrency := flags.Int("concurrency", 4, "number of objects copied in parallel")
+	flags.Parse(args)
+
+	config, err := parseConfig(flags.Args())
+	if err != nil {
+		return err
+	}
+
+	src := make(map[string]string)
+	dst := make(map[string]string)
+	for key, value := range config {
+		if k, found := strings.CutPrefix(key, "src."); found {
+			src[k] = value
+		} else if k, found := strings.CutPrefix(key, "dst."); found {
+			dst[k] = value
+		} else {
+			return fmt.Errorf("invalid configuration %q: expected src.<key> or dst.<key>", key)
+		}
+	}
+
+	t, err := storage.NewTransfer(ctx, src, dst)
+	if err != nil {
+		return err
+	}
+	defer t.Close(ctx)
+
+	report, err := t.Run(ctx, *concurrency)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		return err
+	}
+
+	if len(report.Mismatches) != 0 {
+		return fmt.Errorf("%d object(s) failed verification, run the transfer again", len(report.Mismatches))
+	}
+	return nil
+}
+
+// remotes returns the stores of every remote behind store.
+func remotes(store kstorage.Store) []*storage.RcloneStorage {
+	if replicated, ok := store.(*storage.ReplicatedStorage); ok {
+		return replicated.Replicas()
+	}
+	return []*storage.RcloneStorage{store.(*storage.RcloneStorage)}
+}
+
+// openStore builds the rclone store described by the key=value pairs in args.
+func openStore(ctx context.Context, args []string) (kstorage.Store, error) {
+	config, err := parseConfig(args)
+	if err != nil {
+		return nil, err
+	}
+
+	return storage.NewRcloneStorage(ctx, "rclone", config)
+}
+
+func parseConfig(args []string) (map[string]string, error) {
+	config := make(map[string]string)
+	for _, arg := range args {
+		key, value, found := strings.Cut(arg, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid configuration %q: expected key=value", arg)
+		}
+		config[key] = value
+	}
+	return config, nil
+}
@@ -2,11 +2,9 @@ package exporter
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"net/http"
 	"os"
 	stdpath "path"
 	"strings"
@@ -23,6 +21,7 @@ type RcloneExporter struct {
 	Typee    string
 	Base     string
 	confFile *os.File
+	retry    *utils.RetryPolicy
 }
 
 func NewRcloneExporter(ctx context.Context, opts *exporter.Options, name string, config map[string]string) (exporter.Exporter, error) {
@@ -31,6 +30,11 @@ func NewRcloneExporter(ctx context.Context, opts *exporter.Options, name string,
 		return nil, fmt.Errorf("invalid location: %s. Expected format: location: <provider>://", config["location"])
 	}
 
+	retry, err := utils.ParseRetryPolicy(config)
+	if err != nil {
+		return nil, err
+	}
+
 	utils.CleanPlakarRcloneConf(config)
 	
 	typee, found := config["type"]
@@ -49,6 +53,7 @@ func NewRcloneExporter(ctx context.Context, opts *exporter.Options, name string,
 		Typee:    typee,
 		Base:     base,
 		confFile: file,
+		retry:    retry,
 	}, nil
 }
 
@@ -78,19 +83,14 @@ func (p *RcloneExporter) CreateDirectory(ctx context.Context, pathname string) e
 
 	relativePath := strings.TrimPrefix(pathname, p.GetPathInBackup(""))
 
-	payload := map[string]string{
+	payload := map[string]any{
 		"fs":     fmt.Sprintf("%s:%s", p.Typee, p.Base),
 		"remote": relativePath,
 	}
 
-	jsonPayload, err := json.Marshal(payload)
+	_, err := p.retry.RPC(ctx, "operations/mkdir", payload)
 	if err != nil {
-		return err
-	}
-
-	body, resp := librclone.RPC("operations/mkdir", string(jsonPayload))
-	if resp != http.StatusOK {
-		return fmt.Errorf("failed to create directory: %s", body)
+		return fmt.Errorf("failed to create directory: %w", err)
 	}
 
 	return nil
@@ -133,22 +133,16 @@ func (p *RcloneExporter) StoreFile(ctx context.Context, pathname string, fp io.R
 		}
 	}
 
-	payload := map[string]string{
+	payload := map[string]any{
 		"srcFs":     "/",
 		"srcRemote": tmpFile.Name(),
 		"dstFs":     dstFs,
 		"dstRemote": dstRemoteFunc(),
 	}
 
-	jsonPayload, err := json.Marshal(payload)
+	_, err = p.retry.RPC(ctx, "operations/copyfile", payload)
 	if err != nil {
-		return err
-	}
-
-	body, resp := librclone.RPC("operations/copyfile", string(jsonPayload))
-
-	if resp != http.StatusOK {
-		return fmt.Errorf("failed to copy file: %s", body)
+		return fmt.Errorf("failed to copy file: %w", err)
 	}
 
 	return nil
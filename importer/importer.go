@@ -6,7 +6,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"net/http"
 	"os"
 	stdpath "path"
 	"strings"
@@ -51,6 +50,7 @@ type RcloneImporter struct {
 	Typee    string
 	Base     string
 	confFile *os.File
+	retry    *utils.RetryPolicy
 
 	Ino uint64
 }
@@ -64,6 +64,11 @@ func NewRcloneImporter(ctx context.Context, opts *importer.Options, providerName
 		return nil, fmt.Errorf("invalid location: %s. Expected format: location: <provider>://", config["location"])
 	}
 
+	retry, err := utils.ParseRetryPolicy(config)
+	if err != nil {
+		return nil, err
+	}
+
 	utils.CleanPlakarRcloneConf(config)
 
 	typee, found := config["type"]
@@ -82,6 +87,7 @@ func NewRcloneImporter(ctx context.Context, opts *importer.Options, providerName
 		Typee:    typee,
 		Base:     base,
 		confFile: file,
+		retry:    retry,
 	}, nil
 }
 
@@ -91,7 +97,7 @@ func (p *RcloneImporter) Scan(ctx context.Context) (<-chan *importer.ScanResult,
 
 	go func() {
 		p.GenerateBaseDirectories(results)
-		p.scanRecursive(results, "", &wg)
+		p.scanRecursive(ctx, results, "", &wg)
 		wg.Wait()
 		close(results)
 	}()
@@ -177,29 +183,23 @@ func generatePathComponents(path string) []string {
 	return components
 }
 
-func (p *RcloneImporter) scanRecursive(results chan *importer.ScanResult, path string, wg *sync.WaitGroup) {
-	results, response, err := p.ListFolder(results, path)
+func (p *RcloneImporter) scanRecursive(ctx context.Context, results chan *importer.ScanResult, path string, wg *sync.WaitGroup) {
+	results, response, err := p.ListFolder(ctx, results, path)
 	if err {
 		return
 	}
-	p.scanFolder(results, path, response, wg)
+	p.scanFolder(ctx, results, path, response, wg)
 }
 
-func (p *RcloneImporter) ListFolder(results chan *importer.ScanResult, path string) (chan *importer.ScanResult, Response, bool) {
-	payload := map[string]interface{}{
+func (p *RcloneImporter) ListFolder(ctx context.Context, results chan *importer.ScanResult, path string) (chan *importer.ScanResult, Response, bool) {
+	payload := map[string]any{
 		"fs":     fmt.Sprintf("%s:%s", p.Typee, p.Base),
 		"remote": path,
 	}
 
-	jsonPayload, err := json.Marshal(payload)
+	output, err := p.retry.RPC(ctx, "operations/list", payload)
 	if err != nil {
-		results <- importer.NewScanError(p.GetPathInBackup(path), err)
-		return nil, Response{}, true
-	}
-
-	output, status := librclone.RPC("operations/list", string(jsonPayload))
-	if status != http.StatusOK {
-		results <- importer.NewScanError(p.GetPathInBackup(path), fmt.Errorf("failed to list directory: %s", output))
+		results <- importer.NewScanError(p.GetPathInBackup(path), fmt.Errorf("failed to list directory: %w", err))
 		return nil, Response{}, true
 	}
 
@@ -212,7 +212,7 @@ func (p *RcloneImporter) ListFolder(results chan *importer.ScanResult, path stri
 	return results, response, false
 }
 
-func (p *RcloneImporter) scanFolder(results chan *importer.ScanResult, path string, response Response, wg *sync.WaitGroup) {
+func (p *RcloneImporter) scanFolder(ctx context.Context, results chan *importer.ScanResult, path string, response Response, wg *sync.WaitGroup) {
 	for _, file := range response.List {
 		wg.Add(1)
 		go func() {
@@ -234,7 +234,7 @@ func (p *RcloneImporter) scanFolder(results chan *importer.ScanResult, path stri
 				wg.Add(1)
 				go func() {
 					defer wg.Done()
-					p.scanRecursive(results, file.Path, wg)
+					p.scanRecursive(ctx, results, file.Path, wg)
 				}()
 
 				results <- importer.NewScanRecord(
@@ -277,7 +277,7 @@ func (p *RcloneImporter) scanFolder(results chan *importer.ScanResult, path stri
 					fi,
 					nil,
 					func() (io.ReadCloser, error) {
-						return p.NewReader(file.Path)
+						return p.NewReader(ctx, file.Path)
 					},
 				)
 			}
@@ -323,7 +323,7 @@ func (file *AutoremoveTmpFile) Close() error {
 	return file.File.Close()
 }
 
-func (p *RcloneImporter) NewReader(pathname string) (io.ReadCloser, error) {
+func (p *RcloneImporter) NewReader(ctx context.Context, pathname string) (io.ReadCloser, error) {
 	// pathname is an absolute path within the backup. Let's convert it to a
 	// relative path to the base path.
 	relativePath := strings.TrimPrefix(pathname, p.GetPathInBackup(""))
@@ -332,7 +332,7 @@ func (p *RcloneImporter) NewReader(pathname string) (io.ReadCloser, error) {
 		return nil, err
 	}
 
-	payload := map[string]string{
+	payload := map[string]any{
 		"srcFs":     fmt.Sprintf("%s:%s", p.Typee, p.Base),
 		"srcRemote": strings.TrimPrefix(relativePath, "/"),
 
@@ -340,15 +340,11 @@ func (p *RcloneImporter) NewReader(pathname string) (io.ReadCloser, error) {
 		"dstRemote": stdpath.Base(name),
 	}
 
-	jsonPayload, err := json.Marshal(payload)
+	_, err = p.retry.RPC(ctx, "operations/copyfile", payload)
 	if err != nil {
-		return nil, err
-	}
-
-	body, status := librclone.RPC("operations/copyfile", string(jsonPayload))
-
-	if status != http.StatusOK {
-		return nil, fmt.Errorf("failed to copy file: %s", body)
+		// don't leave a partial download behind
+		os.Remove(name)
+		return nil, fmt.Errorf("failed to copy file: %w", err)
 	}
 
 	tmpFile, err := os.Open(name)
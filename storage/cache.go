@@ -0,0 +1,190 @@
+package storage
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+// diskCache is a size-bounded, least-recently-used cache of remote objects
+// on local disk. Objects are named by their MAC and never change, so
+// entries only go away when evicted or when the object is deleted.
+type diskCache struct {
+	dir     string
+	maxSize int64
+
+	mu      sync.Mutex
+	size    int64
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key  string
+	size int64
+}
+
+func cacheKey(dir string, mac objects.MAC) string {
+	return fmt.Sprintf("%s-%064x", dir, mac)
+}
+
+func blobCacheKey(mac objects.MAC, offset uint64, length uint32) string {
+	return fmt.Sprintf("%s-%d-%d", cacheKey("packfiles", mac), offset, length)
+}
+
+// newDiskCache opens the cache in dir, picking up the entries left by
+// previous runs.
+func newDiskCache(dir string, maxSize int64) (*diskCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory: %w", err)
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cache directory: %w", err)
+	}
+
+	type existing struct {
+		key     string
+		size    int64
+		modTime time.Time
+	}
+	var found []existing
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		if strings.HasPrefix(file.Name(), ".tmp-") {
+			os.Remove(filepath.Join(dir, file.Name()))
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			continue
+		}
+		found = append(found, existing{file.Name(), info.Size(), info.ModTime()})
+	}
+
+	// oldest first, so that the most recently used ends up at the front
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].modTime.Before(found[j].modTime)
+	})
+
+	c := &diskCache{
+		dir:     dir,
+		maxSize: maxSize,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+	for _, e := range found {
+		c.entries[e.key] = c.lru.PushFront(&cacheEntry{e.key, e.size})
+		c.size += e.size
+	}
+	c.evict()
+
+	return c, nil
+}
+
+func (c *diskCache) path(key string) string {
+	return filepath.Join(c.dir, key)
+}
+
+// get opens the cached object key, if present.
+func (c *diskCache) get(key string) (*os.File, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, found := c.entries[key]
+	if !found {
+		return nil, false
+	}
+
+	fp, err := os.Open(c.path(key))
+	if err != nil {
+		c.removeElement(elem)
+		return nil, false
+	}
+
+	c.lru.MoveToFront(elem)
+	now := time.Now()
+	os.Chtimes(c.path(key), now, now)
+
+	return fp, true
+}
+
+// put stores the content of rd as the object key and opens it. Objects
+// larger than the cache itself are not stored and an error is returned.
+func (c *diskCache) put(key string, rd io.Reader) (*os.File, error) {
+	tmp, err := os.CreateTemp(c.dir, ".tmp-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+
+	size, err := io.Copy(tmp, rd)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	if size > c.maxSize {
+		return nil, fmt.Errorf("object %s is larger than the cache", key)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := os.Rename(tmp.Name(), c.path(key)); err != nil {
+		return nil, err
+	}
+	if elem, found := c.entries[key]; found {
+		c.size -= elem.Value.(*cacheEntry).size
+		c.lru.Remove(elem)
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key, size})
+	c.size += size
+	c.evict()
+
+	return os.Open(c.path(key))
+}
+
+// removePrefix drops every object whose key starts with prefix.
+func (c *diskCache) removePrefix(prefix string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, elem := range c.entries {
+		if strings.HasPrefix(key, prefix) {
+			c.removeElement(elem)
+		}
+	}
+}
+
+// evict drops the least recently used objects until the cache fits in its
+// maximum size. It must be called with c.mu held.
+func (c *diskCache) evict() {
+	for c.size > c.maxSize {
+		elem := c.lru.Back()
+		if elem == nil {
+			return
+		}
+		c.removeElement(elem)
+	}
+}
+
+func (c *diskCache) removeElement(elem *list.Element) {
+	entry := elem.Value.(*cacheEntry)
+	os.Remove(c.path(entry.key))
+	c.lru.Remove(elem)
+	delete(c.entries, entry.key)
+	c.size -= entry.size
+}
@@ -0,0 +1,144 @@
+package storage
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func putString(t *testing.T, c *diskCache, key, data string) {
+	t.Helper()
+	fp, err := c.put(key, strings.NewReader(data))
+	if err != nil {
+		t.Fatalf("put %s: %v", key, err)
+	}
+	fp.Close()
+}
+
+func TestDiskCacheGet(t *testing.T) {
+	c, err := newDiskCache(t.TempDir(), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, found := c.get("missing"); found {
+		t.Fatal("found an object never cached")
+	}
+
+	putString(t, c, "a", "hello")
+	fp, found := c.get("a")
+	if !found {
+		t.Fatal("cached object not found")
+	}
+	defer fp.Close()
+
+	data, err := io.ReadAll(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" {
+		t.Fatalf("got %q, expected %q", data, "hello")
+	}
+}
+
+func TestDiskCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c, err := newDiskCache(t.TempDir(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	putString(t, c, "a", "aaaa")
+	putString(t, c, "b", "bbbb")
+
+	// a becomes the most recently used, b is evicted first
+	fp, found := c.get("a")
+	if !found {
+		t.Fatal("a not found")
+	}
+	fp.Close()
+
+	putString(t, c, "c", "cccc")
+
+	if _, found := c.get("b"); found {
+		t.Error("b was not evicted")
+	}
+	if _, err := os.Stat(c.path("b")); !os.IsNotExist(err) {
+		t.Error("file of b was not removed")
+	}
+	for _, key := range []string{"a", "c"} {
+		fp, found := c.get(key)
+		if !found {
+			t.Errorf("%s was evicted", key)
+			continue
+		}
+		fp.Close()
+	}
+	if c.size != 8 {
+		t.Errorf("size is %d, expected 8", c.size)
+	}
+}
+
+func TestDiskCacheRejectsLargeObjects(t *testing.T) {
+	c, err := newDiskCache(t.TempDir(), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.put("a", strings.NewReader("too large")); err == nil {
+		t.Fatal("cached an object larger than the cache")
+	}
+	if _, found := c.get("a"); found {
+		t.Fatal("found an object larger than the cache")
+	}
+}
+
+func TestDiskCacheReopen(t *testing.T) {
+	dir := t.TempDir()
+	c, err := newDiskCache(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putString(t, c, "a", "hello")
+
+	// leftovers of an interrupted put are removed
+	if err := os.WriteFile(filepath.Join(dir, ".tmp-1"), []byte("x"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err = newDiskCache(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp, found := c.get("a")
+	if !found {
+		t.Fatal("object of a previous run not found")
+	}
+	fp.Close()
+	if _, err := os.Stat(filepath.Join(dir, ".tmp-1")); !os.IsNotExist(err) {
+		t.Error("temporary file was not removed")
+	}
+}
+
+func TestDiskCacheRemovePrefix(t *testing.T) {
+	c, err := newDiskCache(t.TempDir(), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putString(t, c, "packfiles-1", "a")
+	putString(t, c, "packfiles-1-0-10", "b")
+	putString(t, c, "packfiles-2", "c")
+
+	c.removePrefix("packfiles-1")
+
+	for key, expected := range map[string]bool{"packfiles-1": false, "packfiles-1-0-10": false, "packfiles-2": true} {
+		fp, found := c.get(key)
+		if found {
+			fp.Close()
+		}
+		if found != expected {
+			t.Errorf("%s found: %v, expected %v", key, found, expected)
+		}
+	}
+}
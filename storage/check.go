@@ -0,0 +1,252 @@
+package storage
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path"
+
+	"github.com/PlakarKorp/kloset/objects"
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/operations"
+	"github.com/rclone/rclone/fs/walk"
+)
+
+// quarantineDir receives the objects set aside by Check in repair mode. They
+// keep their path relative to the repository root.
+const quarantineDir = "quarantine"
+
+const (
+	ProblemInvalidName = "invalid-name"
+	ProblemEmpty       = "empty"
+	ProblemDuplicate   = "duplicate"
+	ProblemMisplaced   = "misplaced"
+	ProblemStray       = "stray"
+)
+
+// CheckIssue describes an object of the repository that kloset can't use
+// as-is.
+type CheckIssue struct {
+	Path    string `json:"path"`
+	Problem string `json:"problem"`
+	Size    int64  `json:"size"`
+
+	// Repaired is set when repair mode moved the object to its proper place
+	// or to the quarantine folder.
+	Repaired    bool   `json:"repaired"`
+	RepairError string `json:"repair_error,omitempty"`
+}
+
+// CheckReport is the result of Check.
+type CheckReport struct {
+	Location  string       `json:"location"`
+	Layout    string       `json:"layout"`
+	States    int          `json:"states"`
+	Packfiles int          `json:"packfiles"`
+	Locks     int          `json:"locks"`
+	Issues    []CheckIssue `json:"issues"`
+
+	// Foreign lists the files whose name is not a MAC, which are skipped
+	// when listing the repository, as returned by ForeignEntries.
+	Foreign []ForeignEntry `json:"foreign"`
+}
+
+// Check audits the objects of the repository without reading their content:
+// names that are not MACs, empty objects, duplicate names as created by some
+// providers, objects in the wrong shard and unknown files at the root. With
+// repair set, misplaced objects are moved to their expected path and other
+// faulty objects are moved to the quarantine folder. As content is not read,
+// a truncated object is only reported when it is empty.
+func (r *RcloneStorage) Check(ctx context.Context, repair bool) (*CheckReport, error) {
+	if repair {
+		if err := r.checkDelete(""); err != nil {
+			return nil, err
+		}
+	}
+
+	layout, err := r.readLayout(ctx)
+	if err != nil {
+		return nil, err
+	}
+	r.layout = layout
+
+	f, err := r.fs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &CheckReport{
+		Location: r.remote(),
+		Layout:   layout,
+		Issues:   []CheckIssue{},
+	}
+
+	var issues []checkIssue
+	for _, dir := range []string{"states", "packfiles", "locks"} {
+		count, dirIssues, err := r.checkFolder(ctx, f, dir)
+		if err != nil {
+			return nil, err
+		}
+		switch dir {
+		case "states":
+			report.States = count
+		case "packfiles":
+			report.Packfiles = count
+		case "locks":
+			report.Locks = count
+		}
+		issues = append(issues, dirIssues...)
+
+		var foreign []Entry
+		for _, issue := range dirIssues {
+			if issue.Problem == ProblemInvalidName {
+				foreign = append(foreign, Entry{Path: issue.Path, Size: issue.Size})
+			}
+		}
+		r.setForeign(dir, foreign)
+	}
+	report.Foreign = r.ForeignEntries()
+
+	rootIssues, err := r.checkRoot(ctx, f)
+	if err != nil {
+		return nil, err
+	}
+	issues = append(issues, rootIssues...)
+
+	for _, issue := range issues {
+		if repair && issue.obj != nil {
+			err := r.repair(ctx, f, issue)
+			if err != nil {
+				issue.RepairError = err.Error()
+			} else {
+				issue.Repaired = true
+			}
+		}
+		report.Issues = append(report.Issues, issue.CheckIssue)
+	}
+
+	return report, nil
+}
+
+type checkIssue struct {
+	CheckIssue
+	obj    fs.Object
+	target string
+}
+
+// checkFolder returns the number of valid objects in dir and the issues
+// found there.
+func (r *RcloneStorage) checkFolder(ctx context.Context, f fs.Fs, dir string) (int, []checkIssue, error) {
+	var objs []fs.Object
+	err := walk.ListR(ctx, f, dir, true, -1, walk.ListObjects, func(entries fs.DirEntries) error {
+		for _, entry := range entries {
+			if obj, ok := entry.(fs.Object); ok {
+				objs = append(objs, obj)
+			}
+		}
+		return nil
+	})
+	if errors.Is(err, fs.ErrorDirNotFound) {
+		return 0, nil, nil
+	} else if err != nil {
+		return 0, nil, fmt.Errorf("failed to list folder %s: %w", dir, err)
+	}
+
+	// the largest object of a set of duplicates is kept, the others are
+	// reported
+	byPath := make(map[string]fs.Object)
+	var issues []checkIssue
+	for _, obj := range objs {
+		kept, found := byPath[obj.Remote()]
+		if !found {
+			byPath[obj.Remote()] = obj
+			continue
+		}
+		if obj.Size() > kept.Size() {
+			byPath[obj.Remote()] = obj
+			obj, kept = kept, obj
+		}
+		issues = append(issues, newCheckIssue(obj, ProblemDuplicate))
+	}
+
+	count := 0
+	for _, obj := range byPath {
+		mac, err := hex.DecodeString(path.Base(obj.Remote()))
+		if err != nil || len(mac) != len(objects.MAC{}) {
+			issues = append(issues, newCheckIssue(obj, ProblemInvalidName))
+			continue
+		}
+
+		if obj.Size() == 0 {
+			issues = append(issues, newCheckIssue(obj, ProblemEmpty))
+			continue
+		}
+
+		if expected := r.objectPath(dir, objects.MAC(mac)); obj.Remote() != expected {
+			issue := newCheckIssue(obj, ProblemMisplaced)
+			issue.target = expected
+			issues = append(issues, issue)
+			continue
+		}
+
+		count++
+	}
+
+	return count, issues, nil
+}
+
+// checkRoot reports the files at the root of the repository that are not
+// part of it.
+func (r *RcloneStorage) checkRoot(ctx context.Context, f fs.Fs) ([]checkIssue, error) {
+	entries, err := f.List(ctx, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list root folder: %w", err)
+	}
+
+	var issues []checkIssue
+	for _, entry := range entries {
+		switch entry.Remote() {
+		case "CONFIG", layoutFile, migrationFile, "states", "packfiles", "locks", stagingDir, quarantineDir:
+			continue
+		}
+
+		if obj, ok := entry.(fs.Object); ok {
+			issues = append(issues, newCheckIssue(obj, ProblemStray))
+		} else {
+			issues = append(issues, checkIssue{CheckIssue: CheckIssue{
+				Path:    entry.Remote(),
+				Problem: ProblemStray,
+				Size:    entry.Size(),
+			}})
+		}
+	}
+
+	return issues, nil
+}
+
+func newCheckIssue(obj fs.Object, problem string) checkIssue {
+	return checkIssue{
+		CheckIssue: CheckIssue{
+			Path:    obj.Remote(),
+			Problem: problem,
+			Size:    obj.Size(),
+		},
+		obj: obj,
+	}
+}
+
+// repair moves the object of issue to its expected path or, failing that,
+// to the quarantine folder.
+func (r *RcloneStorage) repair(ctx context.Context, f fs.Fs, issue checkIssue) error {
+	target := issue.target
+	if target == "" {
+		target = path.Join(quarantineDir, issue.Path)
+		if issue.Problem == ProblemDuplicate {
+			target = fmt.Sprintf("%s.%s", target, randomSuffix())
+		}
+	}
+
+	_, err := operations.Move(ctx, f, nil, target, issue.obj)
+	return err
+}
@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+func writeFile(t *testing.T, name, data string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	ctx := context.Background()
+	store, dir := newLocalRepository(t, map[string]string{"layout": "sharded"})
+
+	var valid, empty, misplaced objects.MAC
+	valid[0] = 0x01
+	empty[0] = 0x02
+	misplaced[0] = 0x03
+
+	writeFile(t, filepath.Join(dir, layoutPath(layoutSharded, "packfiles", valid)), "data")
+	writeFile(t, filepath.Join(dir, layoutPath(layoutSharded, "packfiles", empty)), "")
+	writeFile(t, filepath.Join(dir, layoutPath(layoutFlat, "packfiles", misplaced)), "data")
+	writeFile(t, filepath.Join(dir, "states", "notes.txt"), "foreign")
+	writeFile(t, filepath.Join(dir, "stray"), "stray")
+
+	report, err := store.Check(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Layout != layoutSharded || report.Packfiles != 1 || report.States != 0 {
+		t.Errorf("unexpected report %+v", report)
+	}
+
+	problems := make(map[string]string)
+	for _, issue := range report.Issues {
+		problems[issue.Path] = issue.Problem
+		if issue.Repaired {
+			t.Errorf("%s repaired without repair mode", issue.Path)
+		}
+	}
+	expected := map[string]string{
+		layoutPath(layoutSharded, "packfiles", empty):  ProblemEmpty,
+		layoutPath(layoutFlat, "packfiles", misplaced): ProblemMisplaced,
+		"states/notes.txt": ProblemInvalidName,
+		"stray":            ProblemStray,
+	}
+	if len(problems) != len(expected) {
+		t.Errorf("issues %v, expected %v", problems, expected)
+	}
+	for name, problem := range expected {
+		if problems[name] != problem {
+			t.Errorf("%s: problem %q, expected %q", name, problems[name], problem)
+		}
+	}
+
+	if len(report.Foreign) != 1 || report.Foreign[0].Path != "states/notes.txt" {
+		t.Errorf("foreign entries %v, expected states/notes.txt", report.Foreign)
+	}
+}
+
+func TestCheckRepair(t *testing.T) {
+	ctx := context.Background()
+	store, dir := newLocalRepository(t, map[string]string{"layout": "sharded"})
+
+	var empty, misplaced objects.MAC
+	empty[0] = 0x02
+	misplaced[0] = 0x03
+	writeFile(t, filepath.Join(dir, layoutPath(layoutSharded, "packfiles", empty)), "")
+	writeFile(t, filepath.Join(dir, layoutPath(layoutFlat, "packfiles", misplaced)), "data")
+
+	report, err := store.Check(ctx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, issue := range report.Issues {
+		if !issue.Repaired {
+			t.Errorf("%s not repaired: %s", issue.Path, issue.RepairError)
+		}
+	}
+
+	for name, exists := range map[string]bool{
+		layoutPath(layoutSharded, "packfiles", misplaced):                           true,
+		layoutPath(layoutFlat, "packfiles", misplaced):                              false,
+		filepath.Join(quarantineDir, layoutPath(layoutSharded, "packfiles", empty)): true,
+		layoutPath(layoutSharded, "packfiles", empty):                               false,
+	} {
+		_, err := os.Stat(filepath.Join(dir, name))
+		if (err == nil) != exists {
+			t.Errorf("%s exists: %v, expected %v", name, err == nil, exists)
+		}
+	}
+
+	macs, err := store.GetPackfiles(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(macs) != 1 || macs[0] != misplaced {
+		t.Errorf("packfiles after repair %x, expected %x", macs, misplaced)
+	}
+}
+
+func TestCheckRepairAppendOnly(t *testing.T) {
+	store, _ := newLocalRepository(t, map[string]string{"mode": "append-only"})
+	if _, err := store.Check(context.Background(), true); err == nil {
+		t.Fatal("repair allowed on an append-only store")
+	}
+}
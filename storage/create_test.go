@@ -0,0 +1,86 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+func TestCreateResume(t *testing.T) {
+	ctx := context.Background()
+	dir := filepath.Join(t.TempDir(), "repo")
+
+	// an interrupted creation left the folders and the layout file
+	for _, sub := range repositoryDirs {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile(t, filepath.Join(dir, layoutFile), layoutSharded)
+
+	store := newLocalStore(t, dir, nil)
+	defer store.Close(ctx)
+
+	if _, err := store.Open(ctx); !errors.Is(err, ErrIncomplete) {
+		t.Errorf("open returned %v, expected ErrIncomplete", err)
+	}
+
+	if err := store.Create(ctx, []byte("config")); err != nil {
+		t.Fatal(err)
+	}
+	if fileExists(t, filepath.Join(dir, layoutFile)) {
+		t.Error("layout file of the interrupted creation left")
+	}
+
+	config, err := store.Open(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(config) != "config" || store.layout != layoutFlat {
+		t.Errorf("opened with config %q and the %s layout", config, store.layout)
+	}
+
+	if err := store.Create(ctx, []byte("config")); err == nil {
+		t.Error("existing repository created again")
+	}
+}
+
+func TestCreateHoldingObjects(t *testing.T) {
+	ctx := context.Background()
+	dir := filepath.Join(t.TempDir(), "repo")
+
+	var mac objects.MAC
+	mac[0] = 1
+	packfile := filepath.Join(dir, "packfiles", fmt.Sprintf("%064x", mac))
+	writeFile(t, packfile, "data")
+
+	store := newLocalStore(t, dir, nil)
+	defer store.Close(ctx)
+
+	if err := store.Create(ctx, []byte("config")); err == nil {
+		t.Fatal("repository created over existing packfiles")
+	}
+	if !fileExists(t, packfile) {
+		t.Error("existing packfile removed")
+	}
+	if fileExists(t, filepath.Join(dir, "CONFIG")) {
+		t.Error("config file created")
+	}
+}
+
+func TestOpenIncomplete(t *testing.T) {
+	ctx := context.Background()
+	store, dir := newLocalRepository(t, nil)
+
+	if err := os.Remove(filepath.Join(dir, "locks")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Open(ctx); !errors.Is(err, ErrIncomplete) {
+		t.Errorf("open without the locks folder returned %v, expected ErrIncomplete", err)
+	}
+}
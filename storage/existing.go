@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/PlakarKorp/integration-rclone/utils"
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/hash"
+)
+
+const (
+	// skipExistingOff always uploads objects
+	skipExistingOff = "off"
+
+	// skipExistingSize skips the upload of states and packfiles already on
+	// the remote with the same size
+	skipExistingSize = "size"
+
+	// skipExistingHash skips the upload of states and packfiles already on
+	// the remote with the same size and hash
+	skipExistingHash = "hash"
+)
+
+// isContentAddressed reports whether name is named after its content, so
+// that an existing object under that name holds the same data.
+func isContentAddressed(name string) bool {
+	prefix := tierPrefix(name)
+	return prefix == "states" || prefix == "packfiles"
+}
+
+// skipExisting checks, before name is uploaded, whether the remote already
+// holds it. rd is read to compare its size and, with skip_existing set to
+// hash, its hash with the remote object. What is read is kept as the retry
+// buffer keeps uploads, so that when the upload can't be skipped a reader
+// replaying the content of rd is returned.
+func (r *RcloneStorage) skipExisting(ctx context.Context, f fs.Fs, name string, rd io.Reader) (bool, int64, io.ReadCloser, error) {
+	obj, err := f.NewObject(ctx, name)
+	if errors.Is(err, fs.ErrorObjectNotFound) {
+		return false, 0, nil, nil
+	} else if err != nil {
+		return false, 0, nil, fmt.Errorf("failed to stat file: %w", utils.TranslateError(r.remotePath(name), err))
+	}
+
+	var hasher *hash.MultiHasher
+	hashType := f.Hashes().GetOne()
+	if r.opts.skipExisting == skipExistingHash && hashType != hash.None {
+		hasher, err = hash.NewMultiHasherTypes(hash.NewHashSet(hashType))
+		if err != nil {
+			return false, 0, nil, fmt.Errorf("failed to create %s hasher: %w", hashType, err)
+		}
+	}
+
+	replay := utils.NewRewinder(rd, r.opts.retry.BufferSize, r.opts.retry.Spool)
+
+	var w io.Writer = io.Discard
+	if hasher != nil {
+		w = hasher
+	}
+	size, err := io.Copy(w, replay)
+	if err != nil {
+		replay.Close()
+		return false, 0, nil, err
+	}
+
+	same := obj.Size() == size
+	if same && hasher != nil {
+		remoteSum, err := obj.Hash(ctx, hashType)
+		if err != nil {
+			replay.Close()
+			return false, 0, nil, fmt.Errorf("failed to get %s of %s: %w", hashType, name, err)
+		}
+		sum, err := hasher.SumString(hashType, false)
+		if err != nil {
+			replay.Close()
+			return false, 0, nil, err
+		}
+		// without a remote hash the size check has to do
+		same = remoteSum == "" || hash.Equals(sum, remoteSum)
+	}
+
+	if same {
+		replay.Close()
+		return true, size, nil, nil
+	}
+
+	if r.mode == modeAppendOnly {
+		replay.Close()
+		return false, 0, nil, fmt.Errorf("existing %s doesn't match the data being written: %w", r.remotePath(name), ErrAppendOnly)
+	}
+
+	if err := replay.Rewind(); err != nil {
+		replay.Close()
+		return false, 0, nil, fmt.Errorf("existing %s doesn't match the data being written, which outgrew retry_buffer_size without retry_spool: %w", r.remotePath(name), err)
+	}
+	fs.Logf(nil, "existing %s doesn't match the data being written, uploading it again", name)
+	return false, 0, replay, nil
+}
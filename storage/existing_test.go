@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+// putPackfile puts data as the packfile mac through a reader that can't
+// seek, as kloset's, and returns the content of the stored packfile.
+func putPackfile(t *testing.T, store *RcloneStorage, dir string, mac objects.MAC, data string) (string, error) {
+	t.Helper()
+
+	_, err := store.PutPackfile(context.Background(), mac, struct{ io.Reader }{strings.NewReader(data)})
+	content, rerr := os.ReadFile(filepath.Join(dir, store.objectPath("packfiles", mac)))
+	if rerr != nil {
+		t.Fatal(rerr)
+	}
+	return string(content), err
+}
+
+func TestSkipExisting(t *testing.T) {
+	store, dir := newLocalRepository(t, map[string]string{"skip_existing": "size"})
+
+	var mac objects.MAC
+	mac[0] = 1
+	if _, err := putPackfile(t, store, dir, mac, "data"); err != nil {
+		t.Fatal(err)
+	}
+
+	// same size, the existing packfile is kept
+	content, err := putPackfile(t, store, dir, mac, "atad")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content != "data" {
+		t.Errorf("packfile is %q, expected the existing one to be kept", content)
+	}
+
+	// other size, the packfile is uploaded again
+	content, err = putPackfile(t, store, dir, mac, "longer data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content != "longer data" {
+		t.Errorf("packfile is %q, expected it to be uploaded again", content)
+	}
+}
+
+func TestSkipExistingHash(t *testing.T) {
+	store, dir := newLocalRepository(t, map[string]string{"skip_existing": "hash"})
+
+	var mac objects.MAC
+	mac[0] = 1
+	if _, err := putPackfile(t, store, dir, mac, "data"); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := putPackfile(t, store, dir, mac, "atad")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content != "atad" {
+		t.Errorf("packfile is %q, expected it to be uploaded again", content)
+	}
+}
+
+func TestSkipExistingBufferOutgrown(t *testing.T) {
+	store, dir := newLocalRepository(t, map[string]string{
+		"skip_existing":     "size",
+		"retry_buffer_size": "1k",
+	})
+
+	var mac objects.MAC
+	mac[0] = 1
+	if _, err := putPackfile(t, store, dir, mac, "data"); err != nil {
+		t.Fatal(err)
+	}
+
+	data := strings.Repeat("data", 1000)
+	content, err := putPackfile(t, store, dir, mac, data)
+	if err == nil {
+		t.Fatal("mismatching packfile larger than the retry buffer uploaded without spooling")
+	}
+	if content != "data" {
+		t.Errorf("packfile is %q, expected the existing one to be left", content)
+	}
+}
+
+func TestSkipExistingSpool(t *testing.T) {
+	store, dir := newLocalRepository(t, map[string]string{
+		"skip_existing":     "size",
+		"retry_buffer_size": "1k",
+		"retry_spool":       "true",
+	})
+
+	var mac objects.MAC
+	mac[0] = 1
+	if _, err := putPackfile(t, store, dir, mac, "data"); err != nil {
+		t.Fatal(err)
+	}
+
+	data := strings.Repeat("data", 1000)
+	content, err := putPackfile(t, store, dir, mac, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content != data {
+		t.Error("spooled packfile not uploaded again")
+	}
+}
+
+func TestSkipExistingAppendOnly(t *testing.T) {
+	store, dir := newLocalRepository(t, map[string]string{
+		"skip_existing": "size",
+		"mode":          "append-only",
+	})
+
+	var mac objects.MAC
+	mac[0] = 1
+	if _, err := putPackfile(t, store, dir, mac, "data"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := putPackfile(t, store, dir, mac, "atad"); err != nil {
+		t.Errorf("matching packfile refused: %v", err)
+	}
+	content, err := putPackfile(t, store, dir, mac, "longer data")
+	if !errors.Is(err, ErrAppendOnly) {
+		t.Errorf("mismatching packfile returned %v, expected ErrAppendOnly", err)
+	}
+	if content != "data" {
+		t.Errorf("packfile is %q, expected the existing one to be left", content)
+	}
+}
@@ -0,0 +1,169 @@
+package storage
+
+import (
+	"context"
+	"encoding/hex"
+	"path"
+	"regexp"
+	"sort"
+	"sync"
+
+	"github.com/PlakarKorp/kloset/objects"
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/hash"
+	"github.com/rclone/rclone/fs/operations"
+)
+
+// duplicateName matches the names given by sync clients to conflicting
+// copies of a file, e.g. "<mac> (1)".
+var duplicateName = regexp.MustCompile(`^([0-9a-f]{64}) ?\(\d+\)$`)
+
+// ForeignEntry is a file found in a repository folder whose name is not a
+// MAC, such as ".DS_Store" or "desktop.ini". Such files are skipped when
+// listing the repository.
+type ForeignEntry struct {
+	Path  string `json:"path"`
+	Size  int64  `json:"size"`
+	IsDir bool   `json:"is_dir"`
+}
+
+// foreignEntries remembers the foreign entries seen by the last listing of
+// each repository folder.
+type foreignEntries struct {
+	mu      sync.Mutex
+	entries map[string][]ForeignEntry
+}
+
+func (r *RcloneStorage) setForeign(dir string, entries []Entry) {
+	r.foreign.mu.Lock()
+	defer r.foreign.mu.Unlock()
+
+	if r.foreign.entries == nil {
+		r.foreign.entries = make(map[string][]ForeignEntry)
+	}
+
+	foreign := make([]ForeignEntry, 0, len(entries))
+	for _, entry := range entries {
+		foreign = append(foreign, ForeignEntry{
+			Path:  entry.Path,
+			Size:  entry.Size,
+			IsDir: entry.IsDir,
+		})
+	}
+	r.foreign.entries[dir] = foreign
+}
+
+// ForeignEntries returns the files skipped by the last listing of states,
+// packfiles and locks because their name is not a MAC.
+func (r *RcloneStorage) ForeignEntries() []ForeignEntry {
+	r.foreign.mu.Lock()
+	defer r.foreign.mu.Unlock()
+
+	foreign := []ForeignEntry{}
+	for _, entries := range r.foreign.entries {
+		foreign = append(foreign, entries...)
+	}
+	sort.Slice(foreign, func(i, j int) bool {
+		return foreign[i].Path < foreign[j].Path
+	})
+	return foreign
+}
+
+// reconcileDuplicates resolves the "<mac> (1)" copies found among foreign:
+// a copy of a missing object is renamed to the object name, a copy identical
+// to the object is removed. Copies that differ from the object are left
+// alone and stay foreign.
+func (r *RcloneStorage) reconcileDuplicates(ctx context.Context, macs []objects.MAC, foreign []Entry) ([]objects.MAC, []Entry) {
+	present := make(map[objects.MAC]bool, len(macs))
+	for _, mac := range macs {
+		present[mac] = true
+	}
+
+	var remaining []Entry
+	for _, entry := range foreign {
+		m := duplicateName.FindStringSubmatch(path.Base(entry.Path))
+		if entry.IsDir || m == nil {
+			remaining = append(remaining, entry)
+			continue
+		}
+
+		decoded, err := hex.DecodeString(m[1])
+		if err != nil {
+			remaining = append(remaining, entry)
+			continue
+		}
+		mac := objects.MAC(decoded)
+		original := path.Join(path.Dir(entry.Path), m[1])
+
+		if !present[mac] {
+			if err := r.moveFile(ctx, entry.Path, original); err != nil {
+				fs.Logf(nil, "failed to rename duplicate %s: %v", entry.Path, err)
+				remaining = append(remaining, entry)
+				continue
+			}
+			fs.Logf(nil, "renamed duplicate %s to %s", entry.Path, original)
+			present[mac] = true
+			macs = append(macs, mac)
+			continue
+		}
+
+		// an append-only store keeps the copy rather than failing to remove
+		// it on every listing
+		if r.checkDelete(entry.Path) != nil {
+			remaining = append(remaining, entry)
+			continue
+		}
+
+		same, err := r.sameContent(ctx, original, entry.Path)
+		if err != nil || !same {
+			fs.Logf(nil, "keeping duplicate %s: content differs from %s", entry.Path, original)
+			remaining = append(remaining, entry)
+			continue
+		}
+		if err := r.deleteFile(ctx, entry.Path); err != nil {
+			fs.Logf(nil, "failed to remove duplicate %s: %v", entry.Path, err)
+			remaining = append(remaining, entry)
+			continue
+		}
+		fs.Logf(nil, "removed duplicate %s identical to %s", entry.Path, original)
+	}
+
+	return macs, remaining
+}
+
+// sameContent reports whether the remote objects a and b have the same
+// content, comparing their hashes when the backend supports it and their
+// data otherwise.
+func (r *RcloneStorage) sameContent(ctx context.Context, a, b string) (bool, error) {
+	f, err := r.fs(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	objA, err := f.NewObject(ctx, a)
+	if err != nil {
+		return false, err
+	}
+	objB, err := f.NewObject(ctx, b)
+	if err != nil {
+		return false, err
+	}
+
+	if objA.Size() != objB.Size() {
+		return false, nil
+	}
+
+	if hashType := f.Hashes().GetOne(); hashType != hash.None {
+		sumA, errA := objA.Hash(ctx, hashType)
+		sumB, errB := objB.Hash(ctx, hashType)
+		if errA == nil && errB == nil && sumA != "" && sumB != "" {
+			return hash.Equals(sumA, sumB), nil
+		}
+	}
+
+	differ, err := operations.CheckIdenticalDownload(ctx, objA, objB)
+	if err != nil {
+		return false, err
+	}
+	return !differ, nil
+}
@@ -0,0 +1,128 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/PlakarKorp/kloset/objects"
+	"github.com/rclone/rclone/fs"
+	"golang.org/x/sync/errgroup"
+)
+
+// layoutFile is written at the root of repositories that don't use the flat
+// layout, so that Open knows where to find their objects.
+const layoutFile = "LAYOUT"
+
+const (
+	// layoutFlat stores every object directly below its folder, e.g.
+	// packfiles/<mac>.
+	layoutFlat = "flat"
+
+	// layoutSharded stores states and packfiles in subfolders named after
+	// the first byte of their MAC, e.g. packfiles/ab/ab<...>. Locks are few
+	// and short-lived, so they are kept flat.
+	layoutSharded = "sharded"
+)
+
+func validLayout(layout string) bool {
+	return layout == layoutFlat || layout == layoutSharded
+}
+
+func isSharded(layout, dir string) bool {
+	return layout == layoutSharded && dir != "locks"
+}
+
+func (r *RcloneStorage) isSharded(dir string) bool {
+	return isSharded(r.layout, dir)
+}
+
+// layoutPath returns the path of the object mac within dir for layout.
+func layoutPath(layout, dir string, mac objects.MAC) string {
+	if isSharded(layout, dir) {
+		return fmt.Sprintf("%s/%02x/%064x", dir, mac[0], mac)
+	}
+	return fmt.Sprintf("%s/%064x", dir, mac)
+}
+
+// objectPath returns the path of the object mac within dir for the layout of
+// the repository.
+func (r *RcloneStorage) objectPath(dir string, mac objects.MAC) string {
+	return layoutPath(r.layout, dir, mac)
+}
+
+// readLayout returns the layout recorded in the repository, repositories
+// without a layout file being flat.
+func (r *RcloneStorage) readLayout(ctx context.Context) (string, error) {
+	f, err := r.fs(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	obj, err := f.NewObject(ctx, layoutFile)
+	if errors.Is(err, fs.ErrorObjectNotFound) {
+		return layoutFlat, nil
+	} else if err != nil {
+		return "", fmt.Errorf("failed to get layout file: %w", err)
+	}
+
+	rd, err := obj.Open(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to open layout file: %w", err)
+	}
+	defer rd.Close()
+
+	data, err := io.ReadAll(rd)
+	if err != nil {
+		return "", fmt.Errorf("failed to read layout file: %w", err)
+	}
+
+	layout := strings.TrimSpace(string(data))
+	if !validLayout(layout) {
+		return "", fmt.Errorf("unsupported repository layout %q", layout)
+	}
+	return layout, nil
+}
+
+// listShards lists the shards of dir concurrently and returns the entries
+// found in all of them, along with any file found directly in dir.
+func (r *RcloneStorage) listShards(ctx context.Context, dir string) ([]Entry, error) {
+	shards, err := r.listFolder(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var mu sync.Mutex
+	var files []Entry
+
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(r.opts.listConcurrency)
+	for _, shard := range shards {
+		if !shard.IsDir {
+			mu.Lock()
+			files = append(files, shard)
+			mu.Unlock()
+			continue
+		}
+
+		g.Go(func() error {
+			entries, err := r.listFolder(ctx, shard.Path)
+			if err != nil {
+				return fmt.Errorf("failed to list folder %s: %w", shard.Path, err)
+			}
+
+			mu.Lock()
+			files = append(files, entries...)
+			mu.Unlock()
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+func TestLayoutPath(t *testing.T) {
+	var mac objects.MAC
+	mac[0] = 0xab
+	mac[31] = 0x01
+	hex := fmt.Sprintf("%064x", mac)
+
+	for _, test := range []struct {
+		layout, dir, expected string
+	}{
+		{layoutFlat, "packfiles", "packfiles/" + hex},
+		{layoutFlat, "states", "states/" + hex},
+		{layoutSharded, "packfiles", "packfiles/ab/" + hex},
+		{layoutSharded, "states", "states/ab/" + hex},
+		{layoutSharded, "locks", "locks/" + hex},
+	} {
+		if got := layoutPath(test.layout, test.dir, mac); got != test.expected {
+			t.Errorf("%s layout, %s: got %s, expected %s", test.layout, test.dir, got, test.expected)
+		}
+	}
+}
+
+func TestValidLayout(t *testing.T) {
+	for layout, expected := range map[string]bool{
+		layoutFlat:    true,
+		layoutSharded: true,
+		"":            false,
+		"nested":      false,
+	} {
+		if got := validLayout(layout); got != expected {
+			t.Errorf("validLayout(%q) = %v, expected %v", layout, got, expected)
+		}
+	}
+}
+
+func TestEntriesToMacs(t *testing.T) {
+	var a, b objects.MAC
+	a[0] = 1
+	b[0] = 2
+
+	entries := []Entry{
+		{Path: fmt.Sprintf("packfiles/%064x", a)},
+		{Path: fmt.Sprintf("packfiles/02/%064x", b)},
+		{Path: "packfiles/02", IsDir: true},
+		{Path: "packfiles/desktop.ini"},
+		{Path: fmt.Sprintf("packfiles/%064x (1)", a)},
+		{Path: "packfiles/" + strings.Repeat("ab", 16)},
+	}
+
+	macs, foreign := entriesToMacs(entries)
+	if len(macs) != 2 || macs[0] != a || macs[1] != b {
+		t.Errorf("got MACs %x, expected %x and %x", macs, a, b)
+	}
+	if len(foreign) != 4 {
+		t.Fatalf("got %d foreign entries, expected 4", len(foreign))
+	}
+	for i, entry := range foreign {
+		if entry != entries[i+2] {
+			t.Errorf("foreign entry %d is %s, expected %s", i, entry.Path, entries[i+2].Path)
+		}
+	}
+}
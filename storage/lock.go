@@ -0,0 +1,213 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/PlakarKorp/integration-rclone/utils"
+	"github.com/PlakarKorp/kloset/objects"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+	"github.com/rclone/rclone/fs"
+)
+
+// Locks are leases: kloset rewrites its locks periodically, which bumps
+// their modification time on the remote. With lockTTL set, a lock that
+// hasn't been rewritten for that long is considered abandoned by a crashed
+// host and is not reported.
+//
+// On s3 remotes, locks are written with conditional requests: a lock is
+// created only if it doesn't exist yet, and renewed only if it is still the
+// object this store wrote, so that a lock replaced or removed by another
+// host is reported as lost. Other providers, including GCS whose generation
+// checks rclone doesn't expose, don't offer conditional writes through
+// rclone, so a lock is only reported as taken once it shows up in the
+// listing of locks/. This way, a host that lists the locks after PutLock
+// returned is guaranteed to see it, even on providers whose listings lag
+// behind writes.
+
+// Errors returned by PutLock on remotes supporting conditional writes.
+var (
+	ErrLockHeld = errors.New("lock held by another host")
+	ErrLockLost = errors.New("lock replaced or removed by another host")
+)
+
+// conditionalLocks remembers the ETag of the locks written by the store, to
+// renew them conditionally.
+type conditionalLocks struct {
+	mu    sync.Mutex
+	etags map[string]string
+
+	// unsupported is set once the provider refused conditional writes
+	unsupported atomic.Bool
+}
+
+func (r *RcloneStorage) GetLocks(ctx context.Context) ([]objects.MAC, error) {
+	entries, err := r.listFolder(ctx, "locks")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list folder locks: %w", err)
+	}
+
+	var live []Entry
+	for _, entry := range entries {
+		if !r.isStaleLock(entry) {
+			live = append(live, entry)
+			continue
+		}
+
+		if !r.opts.lockRemoveStale || r.mode == modeReadOnly {
+			fs.Logf(nil, "ignoring stale lock %s, last renewed %s", entry.Path, entry.ModTime)
+			continue
+		}
+		if err := r.deleteFile(ctx, entry.Path); err != nil {
+			fs.Logf(nil, "failed to remove stale lock %s: %v", entry.Path, err)
+		} else {
+			fs.Logf(nil, "removed stale lock %s, last renewed %s", entry.Path, entry.ModTime)
+		}
+	}
+
+	macs, foreign := entriesToMacs(live)
+	r.setForeign("locks", foreign)
+
+	return macs, nil
+}
+
+func (r *RcloneStorage) PutLock(ctx context.Context, lockID objects.MAC, rd io.Reader) (int64, error) {
+	name := r.objectPath("locks", lockID)
+
+	if r.s3 != nil && len(r.overlays) == 0 && !r.locks.unsupported.Load() {
+		data, err := io.ReadAll(rd)
+		if err != nil {
+			return 0, err
+		}
+		size, err := r.putLockConditional(ctx, name, data)
+		if !errors.Is(err, errors.ErrUnsupported) {
+			return size, err
+		}
+		fs.Logf(nil, "conditional writes not supported at %s, verifying locks by listing them", r.remote())
+		r.locks.unsupported.Store(true)
+		rd = bytes.NewReader(data)
+	}
+
+	size, err := r.putFile(ctx, name, rd)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := r.waitLockVisible(ctx, name, size); err != nil {
+		r.deleteFile(context.WithoutCancel(ctx), name)
+		return 0, err
+	}
+
+	return size, nil
+}
+
+// putLockConditional writes the lock name with a conditional request: it
+// must not exist when the store first writes it, and must still be the
+// object written by the store when it is renewed. It fails with
+// errors.ErrUnsupported if the provider doesn't support conditional writes.
+func (r *RcloneStorage) putLockConditional(ctx context.Context, name string, data []byte) (int64, error) {
+	if err := r.checkWrite(name); err != nil {
+		return 0, err
+	}
+
+	r.locks.mu.Lock()
+	etag, renewing := r.locks.etags[name]
+	r.locks.mu.Unlock()
+
+	input := &s3.PutObjectInput{
+		Bucket: aws.String(r.s3.bucket),
+		Key:    aws.String(r.s3.key(name)),
+		Body:   bytes.NewReader(data),
+	}
+	if renewing {
+		input.IfMatch = aws.String(etag)
+	} else {
+		input.IfNoneMatch = aws.String("*")
+	}
+
+	out, err := r.s3.client.PutObject(ctx, input)
+	if err != nil {
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) {
+			switch apiErr.ErrorCode() {
+			case "NotImplemented":
+				return 0, errors.ErrUnsupported
+			case "PreconditionFailed", "ConditionalRequestConflict", "NoSuchKey":
+				if renewing {
+					r.forgetLock(name)
+					return 0, fmt.Errorf("failed to renew lock %s: %w", name, ErrLockLost)
+				}
+				return 0, fmt.Errorf("failed to take lock %s: %w", name, ErrLockHeld)
+			}
+		}
+		return 0, fmt.Errorf("failed to write lock %s: %w", name, utils.TranslateError(r.remotePath(name), err))
+	}
+
+	r.locks.mu.Lock()
+	if r.locks.etags == nil {
+		r.locks.etags = make(map[string]string)
+	}
+	r.locks.etags[name] = aws.ToString(out.ETag)
+	r.locks.mu.Unlock()
+
+	return int64(len(data)), nil
+}
+
+// forgetLock stops renewing the lock name conditionally.
+func (r *RcloneStorage) forgetLock(name string) {
+	r.locks.mu.Lock()
+	delete(r.locks.etags, name)
+	r.locks.mu.Unlock()
+}
+
+// isStaleLock reports whether the lease of the lock entry expired.
+func (r *RcloneStorage) isStaleLock(entry Entry) bool {
+	if r.opts.lockTTL <= 0 {
+		return false
+	}
+
+	modTime, err := time.Parse(time.RFC3339, entry.ModTime)
+	if err != nil {
+		return false
+	}
+	return time.Since(modTime) > r.opts.lockTTL
+}
+
+// waitLockVisible lists locks/ until the lock name of the given size shows
+// up, or gives up after lockVerifyTimeout.
+func (r *RcloneStorage) waitLockVisible(ctx context.Context, name string, size int64) error {
+	deadline := time.Now().Add(r.opts.lockVerifyTimeout)
+	delay := 100 * time.Millisecond
+
+	for {
+		entries, err := r.listFolder(ctx, path.Dir(name))
+		if err != nil {
+			return fmt.Errorf("failed to verify lock %s: %w", name, err)
+		}
+		for _, entry := range entries {
+			if entry.Path == name && entry.Size == size {
+				return nil
+			}
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("lock %s is not visible on the remote after %s", name, r.opts.lockVerifyTimeout)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay = min(2*delay, 5*time.Second)
+	}
+}
@@ -0,0 +1,157 @@
+package storage
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+// migrationFile is written at the root of a repository while its layout is
+// being converted. It holds the target layout so that an interrupted
+// migration can be resumed, and prevents Open from using the repository
+// until the migration completes.
+const migrationFile = "MIGRATING"
+
+// Migrate converts the repository in place to layout by renaming its states
+// and packfiles, server-side when the backend supports it. It refuses to run
+// while the repository is locked. If interrupted, calling it again with the
+// same layout resumes the conversion.
+func (r *RcloneStorage) Migrate(ctx context.Context, layout string) error {
+	if !validLayout(layout) {
+		return fmt.Errorf("invalid layout %q: expected flat or sharded", layout)
+	}
+	if err := r.checkDelete(""); err != nil {
+		return err
+	}
+
+	current, err := r.readLayout(ctx)
+	if err != nil {
+		return err
+	}
+	r.layout = current
+
+	resuming, err := r.exists(ctx, migrationFile)
+	if err != nil {
+		return err
+	}
+	if resuming {
+		target, err := r.readMigrationTarget(ctx)
+		if err != nil {
+			return err
+		}
+		if target != layout {
+			return fmt.Errorf("an interrupted migration to the %s layout must be completed first", target)
+		}
+	} else {
+		if current == layout {
+			return nil
+		}
+		_, err = r.putFile(ctx, migrationFile, strings.NewReader(layout))
+		if err != nil {
+			return fmt.Errorf("failed to create migration file: %w", err)
+		}
+	}
+
+	// the migration file makes Open refuse the repository, so no lock can
+	// be taken once it is written
+	if err := r.checkUnlocked(ctx); err != nil {
+		if !resuming {
+			if rerr := r.deleteFile(context.WithoutCancel(ctx), migrationFile); rerr != nil {
+				return fmt.Errorf("%w, and failed to remove migration file: %w", err, rerr)
+			}
+		}
+		return err
+	}
+
+	for _, dir := range []string{"states", "packfiles"} {
+		if err := r.migrateFolder(ctx, dir, layout); err != nil {
+			return err
+		}
+	}
+
+	if layout == layoutFlat {
+		if ok, err := r.exists(ctx, layoutFile); err != nil {
+			return err
+		} else if ok {
+			if err := r.deleteFile(ctx, layoutFile); err != nil {
+				return err
+			}
+		}
+	} else {
+		_, err = r.putFile(ctx, layoutFile, strings.NewReader(layout))
+		if err != nil {
+			return fmt.Errorf("failed to create layout file: %w", err)
+		}
+	}
+	r.layout = layout
+
+	return r.deleteFile(ctx, migrationFile)
+}
+
+// checkUnlocked fails if the repository holds locks.
+func (r *RcloneStorage) checkUnlocked(ctx context.Context) error {
+	locks, err := r.getMacs(ctx, "locks")
+	if err != nil {
+		return err
+	}
+	if len(locks) != 0 {
+		return fmt.Errorf("repository at %s is locked by %d lock(s), refusing to migrate", r.remote(), len(locks))
+	}
+	return nil
+}
+
+// migrateFolder moves every object of dir that is not yet at its place in
+// layout. Objects already moved by an interrupted run are left untouched.
+func (r *RcloneStorage) migrateFolder(ctx context.Context, dir, layout string) error {
+	entries, err := r.listFiles(ctx, dir)
+	if err != nil {
+		return fmt.Errorf("failed to list folder %s: %w", dir, err)
+	}
+
+	for _, entry := range entries {
+		mac, err := hex.DecodeString(path.Base(entry.Path))
+		if err != nil || len(mac) != len(objects.MAC{}) {
+			return fmt.Errorf("unexpected file %s in %s, refusing to migrate", entry.Path, dir)
+		}
+
+		target := layoutPath(layout, dir, objects.MAC(mac))
+		if entry.Path == target {
+			continue
+		}
+		if err := r.moveFile(ctx, entry.Path, target); err != nil {
+			return err
+		}
+	}
+
+	if layout == layoutFlat {
+		if err := r.rmdirs(ctx, dir); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *RcloneStorage) readMigrationTarget(ctx context.Context) (string, error) {
+	rd, err := r.getFile(ctx, migrationFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to open migration file: %w", err)
+	}
+	defer rd.Close()
+
+	data, err := io.ReadAll(rd)
+	if err != nil {
+		return "", fmt.Errorf("failed to read migration file: %w", err)
+	}
+
+	target := strings.TrimSpace(string(data))
+	if !validLayout(target) {
+		return "", fmt.Errorf("unsupported migration target %q", target)
+	}
+	return target, nil
+}
@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+func fileExists(t *testing.T, name string) bool {
+	t.Helper()
+	_, err := os.Stat(name)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return err == nil
+}
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	store, dir := newLocalRepository(t, nil)
+
+	var state, packfile objects.MAC
+	state[0] = 0x01
+	packfile[0] = 0x02
+	if _, err := store.PutState(ctx, state, strings.NewReader("state")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.PutPackfile(ctx, packfile, strings.NewReader("packfile")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, layout := range []string{layoutSharded, layoutFlat} {
+		if err := store.Migrate(ctx, layout); err != nil {
+			t.Fatalf("migration to %s: %v", layout, err)
+		}
+
+		for _, object := range []struct {
+			dir string
+			mac objects.MAC
+		}{{"states", state}, {"packfiles", packfile}} {
+			if !fileExists(t, filepath.Join(dir, layoutPath(layout, object.dir, object.mac))) {
+				t.Errorf("%s %x not moved to the %s layout", object.dir, object.mac, layout)
+			}
+		}
+		if fileExists(t, filepath.Join(dir, migrationFile)) {
+			t.Errorf("migration file left after the migration to %s", layout)
+		}
+		if fileExists(t, filepath.Join(dir, layoutFile)) != (layout == layoutSharded) {
+			t.Errorf("unexpected layout file after the migration to %s", layout)
+		}
+		if _, err := store.Open(ctx); err != nil {
+			t.Fatalf("open after the migration to %s: %v", layout, err)
+		}
+		if store.layout != layout {
+			t.Errorf("opened with the %s layout, expected %s", store.layout, layout)
+		}
+	}
+
+	if fileExists(t, filepath.Join(dir, "packfiles", "02")) {
+		t.Error("shard folder left after the migration to flat")
+	}
+}
+
+func TestMigrateResume(t *testing.T) {
+	ctx := context.Background()
+	store, dir := newLocalRepository(t, nil)
+
+	var moved, left objects.MAC
+	moved[0] = 0x01
+	left[0] = 0x02
+	for _, mac := range []objects.MAC{moved, left} {
+		if _, err := store.PutPackfile(ctx, mac, strings.NewReader("packfile")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// an interrupted migration to sharded moved the first packfile only
+	writeFile(t, filepath.Join(dir, migrationFile), layoutSharded)
+	if err := os.MkdirAll(filepath.Join(dir, "packfiles", "01"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(dir, layoutPath(layoutFlat, "packfiles", moved)),
+		filepath.Join(dir, layoutPath(layoutSharded, "packfiles", moved))); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.Open(ctx); err == nil {
+		t.Fatal("repository opened during a migration")
+	}
+	if err := store.Migrate(ctx, layoutFlat); err == nil {
+		t.Fatal("migration to another layout than the interrupted one accepted")
+	}
+	if err := store.Migrate(ctx, layoutSharded); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.Open(ctx); err != nil {
+		t.Fatal(err)
+	}
+	macs, err := store.GetPackfiles(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(macs) != 2 {
+		t.Errorf("got packfiles %x after resuming, expected both", macs)
+	}
+	for _, mac := range []objects.MAC{moved, left} {
+		if !fileExists(t, filepath.Join(dir, layoutPath(layoutSharded, "packfiles", mac))) {
+			t.Errorf("packfile %x not in the sharded layout", mac)
+		}
+	}
+}
+
+func TestMigrateLocked(t *testing.T) {
+	ctx := context.Background()
+	store, dir := newLocalRepository(t, nil)
+
+	var lock objects.MAC
+	lock[0] = 0x01
+	if _, err := store.PutLock(ctx, lock, strings.NewReader("lock")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Migrate(ctx, layoutSharded); err == nil {
+		t.Fatal("locked repository migrated")
+	}
+	if fileExists(t, filepath.Join(dir, migrationFile)) {
+		t.Error("migration file left after refusing to migrate")
+	}
+	if _, err := store.Open(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
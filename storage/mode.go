@@ -0,0 +1,99 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	iofs "io/fs"
+	"strings"
+	"time"
+
+	"github.com/PlakarKorp/integration-rclone/utils"
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/operations"
+)
+
+const (
+	// modeReadWrite allows every operation
+	modeReadWrite = "read-write"
+
+	// modeReadOnly refuses any change to the repository
+	modeReadOnly = "read-only"
+
+	// modeAppendOnly allows new objects to be written but refuses to delete
+	// or overwrite states and packfiles. Locks can still be released.
+	modeAppendOnly = "append-only"
+)
+
+// Errors returned by the operations refused by the mode of the store.
+var (
+	ErrReadOnly   = errors.New("repository is read-only")
+	ErrAppendOnly = errors.New("repository is append-only")
+)
+
+// checkWrite fails if the store can't be written to.
+func (r *RcloneStorage) checkWrite(name string) error {
+	if r.mode == modeReadOnly {
+		return fmt.Errorf("cannot write %s: %w", r.remotePath(name), ErrReadOnly)
+	}
+	return nil
+}
+
+// checkDelete fails if states and packfiles can't be removed or rewritten.
+func (r *RcloneStorage) checkDelete(name string) error {
+	if err := r.checkWrite(name); err != nil {
+		return err
+	}
+	if r.mode == modeAppendOnly {
+		return fmt.Errorf("cannot remove %s: %w", r.remotePath(name), ErrAppendOnly)
+	}
+	return nil
+}
+
+// checkOverwrite fails if name is a state or packfile that would be
+// overwritten by an upload in append-only mode.
+func (r *RcloneStorage) checkOverwrite(ctx context.Context, f fs.Fs, name string) error {
+	if r.mode != modeAppendOnly || !isContentAddressed(name) {
+		return nil
+	}
+
+	_, err := f.NewObject(ctx, name)
+	if errors.Is(err, fs.ErrorObjectNotFound) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to stat file: %w", utils.TranslateError(r.remotePath(name), err))
+	}
+	return fmt.Errorf("cannot overwrite %s: %w", r.remotePath(name), ErrAppendOnly)
+}
+
+// probeWrite writes and removes a small object in the staging folder to find
+// out whether the credentials allow writes, and switches the store to
+// read-only if they don't. Other failures are only logged, the operations
+// that need to write will report them.
+func (r *RcloneStorage) probeWrite(ctx context.Context) {
+	if r.mode == modeReadOnly || !r.opts.writeProbe {
+		return
+	}
+
+	f, err := r.fs(ctx)
+	if err != nil {
+		return
+	}
+
+	name := stagingPath("probe")
+	obj, err := operations.Rcat(ctx, f, name, io.NopCloser(strings.NewReader("probe")), time.Now(), nil)
+	if errors.Is(utils.TranslateError(r.remotePath(name), err), iofs.ErrPermission) {
+		fs.Logf(nil, "no write permission at %s, opening it read-only", r.remote())
+		r.mode = modeReadOnly
+		return
+	} else if err != nil {
+		fs.Logf(nil, "failed to probe write permission at %s: %v", r.remote(), err)
+		return
+	}
+
+	// an object left behind is removed with the other stale staging objects
+	if err := obj.Remove(ctx); err != nil {
+		fs.Logf(obj, "failed to remove write probe: %v", err)
+	}
+}
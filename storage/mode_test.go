@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+func TestAppendOnly(t *testing.T) {
+	ctx := context.Background()
+	store, dir := newLocalRepository(t, map[string]string{"mode": "append-only"})
+
+	var mac objects.MAC
+	mac[0] = 1
+	if _, err := store.PutPackfile(ctx, mac, strings.NewReader("data")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.PutPackfile(ctx, mac, strings.NewReader("other")); !errors.Is(err, ErrAppendOnly) {
+		t.Errorf("overwrite returned %v, expected ErrAppendOnly", err)
+	}
+	if err := store.DeletePackfile(ctx, mac); !errors.Is(err, ErrAppendOnly) {
+		t.Errorf("delete returned %v, expected ErrAppendOnly", err)
+	}
+	if err := store.deleteFile(ctx, store.objectPath("packfiles", mac)); !errors.Is(err, ErrAppendOnly) {
+		t.Errorf("deleteFile returned %v, expected ErrAppendOnly", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, store.objectPath("packfiles", mac))); err != nil {
+		t.Error("packfile removed from an append-only store")
+	}
+
+	// locks are still released
+	if _, err := store.PutLock(ctx, mac, strings.NewReader("lock")); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DeleteLock(ctx, mac); err != nil {
+		t.Errorf("lock not released: %v", err)
+	}
+}
+
+func TestAppendOnlyKeepsDuplicates(t *testing.T) {
+	ctx := context.Background()
+	store, dir := newLocalRepository(t, map[string]string{"mode": "append-only", "reconcile_duplicates": "true"})
+
+	var mac objects.MAC
+	mac[0] = 1
+	if _, err := store.PutPackfile(ctx, mac, strings.NewReader("data")); err != nil {
+		t.Fatal(err)
+	}
+	duplicate := filepath.Join(dir, store.objectPath("packfiles", mac)+" (1)")
+	if err := os.WriteFile(duplicate, []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.GetPackfiles(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(duplicate); err != nil {
+		t.Error("duplicate removed from an append-only store")
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	ctx := context.Background()
+	store, _ := newLocalRepository(t, nil)
+	store.mode = modeReadOnly
+
+	var mac objects.MAC
+	if _, err := store.PutState(ctx, mac, strings.NewReader("state")); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("put returned %v, expected ErrReadOnly", err)
+	}
+	if err := store.DeleteLock(ctx, mac); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("lock deletion returned %v, expected ErrReadOnly", err)
+	}
+}
+
+func TestOpenMissingWritesNothing(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "repo")
+	store := newLocalStore(t, dir, nil)
+	defer store.Close(context.Background())
+
+	if _, err := store.Open(context.Background()); err == nil {
+		t.Fatal("opened a missing repository")
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Error("opening a missing repository wrote to it")
+	}
+}
@@ -0,0 +1,332 @@
+package storage
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/PlakarKorp/integration-rclone/utils"
+	"github.com/rclone/rclone/fs"
+)
+
+// options holds the settings consumed by the storage connector itself. They
+// are removed from the configuration before the rest of it is handed over to
+// rclone as the remote definition.
+type options struct {
+	mode       string
+	writeProbe bool
+
+	sizeMode     string
+	sizeCacheTTL time.Duration
+
+	layout          string
+	listConcurrency int
+
+	atomicUploads bool
+	stagingMaxAge time.Duration
+	verifyUploads bool
+	skipExisting  string
+
+	reconcileDuplicates bool
+
+	cacheDir     string
+	cacheMaxSize int64
+
+	lockTTL           time.Duration
+	lockRemoveStale   bool
+	lockVerifyTimeout time.Duration
+
+	retentionMode   string
+	retentionPeriod time.Duration
+
+	// tiers maps a repository prefix to the storage class of its objects
+	tiers map[string]string
+
+	restorePolicy       string
+	restorePriority     string
+	restoreDays         int
+	restoreTier         string
+	restoreTimeout      time.Duration
+	restorePollInterval time.Duration
+
+	retry *utils.RetryPolicy
+
+	transfers          int
+	multiThreadStreams int // -1 keeps rclone's default
+	multiThreadCutoff  int64
+	uploadChunkSize    int64
+	uploadConcurrency  int
+}
+
+func parseOptions(config map[string]string) (*options, error) {
+	opts := &options{
+		mode:       modeReadWrite,
+		writeProbe: true,
+
+		sizeMode:     "list",
+		sizeCacheTTL: 5 * time.Minute,
+
+		layout:          layoutFlat,
+		listConcurrency: 8,
+
+		atomicUploads: true,
+		stagingMaxAge: 24 * time.Hour,
+		verifyUploads: true,
+		skipExisting:  skipExistingOff,
+
+		cacheMaxSize: 1 << 30,
+
+		// kloset expires locks by the timestamp they hold, so every lock
+		// is reported unless lock_ttl is set
+		lockVerifyTimeout: 30 * time.Second,
+
+		retentionMode: "governance",
+
+		tiers: make(map[string]string),
+
+		restorePolicy:       restoreFail,
+		restorePriority:     "Standard",
+		restoreDays:         1,
+		restoreTier:         "Hot",
+		restoreTimeout:      48 * time.Hour,
+		restorePollInterval: time.Minute,
+
+		multiThreadStreams: -1,
+	}
+
+	retry, err := utils.ParseRetryPolicy(config)
+	if err != nil {
+		return nil, err
+	}
+	opts.retry = retry
+
+	if v, ok := popOption(config, "mode"); ok {
+		if v != modeReadWrite && v != modeReadOnly && v != modeAppendOnly {
+			return nil, fmt.Errorf("invalid mode %q: expected read-write, read-only or append-only", v)
+		}
+		opts.mode = v
+	}
+
+	if v, ok := popOption(config, "write_probe"); ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid write_probe %q: %w", v, err)
+		}
+		opts.writeProbe = b
+	}
+
+	if v, ok := popOption(config, "size_mode"); ok {
+		if v != "list" && v != "about" {
+			return nil, fmt.Errorf("invalid size_mode %q: expected list or about", v)
+		}
+		opts.sizeMode = v
+	}
+
+	if v, ok := popOption(config, "size_cache_ttl"); ok {
+		ttl, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid size_cache_ttl %q: %w", v, err)
+		}
+		opts.sizeCacheTTL = ttl
+	}
+
+	if v, ok := popOption(config, "layout"); ok {
+		if !validLayout(v) {
+			return nil, fmt.Errorf("invalid layout %q: expected flat or sharded", v)
+		}
+		opts.layout = v
+	}
+
+	if v, ok := popOption(config, "list_concurrency"); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid list_concurrency %q: expected a positive integer", v)
+		}
+		opts.listConcurrency = n
+	}
+
+	if v, ok := popOption(config, "atomic_uploads"); ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid atomic_uploads %q: %w", v, err)
+		}
+		opts.atomicUploads = b
+	}
+
+	if v, ok := popOption(config, "staging_max_age"); ok {
+		age, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid staging_max_age %q: %w", v, err)
+		}
+		opts.stagingMaxAge = age
+	}
+
+	if v, ok := popOption(config, "verify_uploads"); ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid verify_uploads %q: %w", v, err)
+		}
+		opts.verifyUploads = b
+	}
+
+	if v, ok := popOption(config, "skip_existing"); ok {
+		if v != skipExistingOff && v != skipExistingSize && v != skipExistingHash {
+			return nil, fmt.Errorf("invalid skip_existing %q: expected off, size or hash", v)
+		}
+		opts.skipExisting = v
+	}
+
+	if v, ok := popOption(config, "reconcile_duplicates"); ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid reconcile_duplicates %q: %w", v, err)
+		}
+		opts.reconcileDuplicates = b
+	}
+
+	if v, ok := popOption(config, "cache_dir"); ok {
+		opts.cacheDir = v
+	}
+
+	if v, ok := popOption(config, "cache_max_size"); ok {
+		var size fs.SizeSuffix
+		if err := size.Set(v); err != nil || size <= 0 {
+			return nil, fmt.Errorf("invalid cache_max_size %q: expected a size such as 512M or 10G", v)
+		}
+		opts.cacheMaxSize = int64(size)
+	}
+
+	if v, ok := popOption(config, "lock_ttl"); ok {
+		ttl, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid lock_ttl %q: %w", v, err)
+		}
+		opts.lockTTL = ttl
+	}
+
+	if v, ok := popOption(config, "lock_remove_stale"); ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid lock_remove_stale %q: %w", v, err)
+		}
+		opts.lockRemoveStale = b
+	}
+
+	if v, ok := popOption(config, "lock_verify_timeout"); ok {
+		timeout, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid lock_verify_timeout %q: %w", v, err)
+		}
+		opts.lockVerifyTimeout = timeout
+	}
+
+	if v, ok := popOption(config, "retention_mode"); ok {
+		if v != "governance" && v != "compliance" {
+			return nil, fmt.Errorf("invalid retention_mode %q: expected governance or compliance", v)
+		}
+		opts.retentionMode = v
+	}
+
+	if v, ok := popOption(config, "retention_days"); ok {
+		days, err := strconv.Atoi(v)
+		if err != nil || days < 1 {
+			return nil, fmt.Errorf("invalid retention_days %q: expected a positive number of days", v)
+		}
+		opts.retentionPeriod = time.Duration(days) * 24 * time.Hour
+	}
+
+	for _, prefix := range tierPrefixes {
+		if v, ok := popOption(config, "tier_"+prefix); ok && v != "" {
+			opts.tiers[prefix] = v
+		}
+	}
+
+	if v, ok := popOption(config, "archive_restore"); ok {
+		if v != restoreFail && v != restoreRequest && v != restoreWait {
+			return nil, fmt.Errorf("invalid archive_restore %q: expected fail, request or wait", v)
+		}
+		opts.restorePolicy = v
+	}
+
+	if v, ok := popOption(config, "archive_restore_priority"); ok {
+		opts.restorePriority = v
+	}
+
+	if v, ok := popOption(config, "archive_restore_days"); ok {
+		days, err := strconv.Atoi(v)
+		if err != nil || days < 1 {
+			return nil, fmt.Errorf("invalid archive_restore_days %q: expected a positive number of days", v)
+		}
+		opts.restoreDays = days
+	}
+
+	if v, ok := popOption(config, "archive_restore_tier"); ok {
+		opts.restoreTier = v
+	}
+
+	if v, ok := popOption(config, "archive_restore_timeout"); ok {
+		timeout, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid archive_restore_timeout %q: %w", v, err)
+		}
+		opts.restoreTimeout = timeout
+	}
+
+	if v, ok := popOption(config, "archive_restore_poll_interval"); ok {
+		interval, err := time.ParseDuration(v)
+		if err != nil || interval <= 0 {
+			return nil, fmt.Errorf("invalid archive_restore_poll_interval %q: expected a positive duration", v)
+		}
+		opts.restorePollInterval = interval
+	}
+
+	if v, ok := popOption(config, "transfers"); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid transfers %q: expected a positive integer, or 0 for no limit", v)
+		}
+		opts.transfers = n
+	}
+
+	if v, ok := popOption(config, "multi_thread_streams"); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid multi_thread_streams %q: expected a positive integer, or 0 to disable them", v)
+		}
+		opts.multiThreadStreams = n
+	}
+
+	if v, ok := popOption(config, "multi_thread_cutoff"); ok {
+		var size fs.SizeSuffix
+		if err := size.Set(v); err != nil || size <= 0 {
+			return nil, fmt.Errorf("invalid multi_thread_cutoff %q: expected a size such as 64M", v)
+		}
+		opts.multiThreadCutoff = int64(size)
+	}
+
+	if v, ok := popOption(config, "upload_chunk_size"); ok {
+		var size fs.SizeSuffix
+		if err := size.Set(v); err != nil || size <= 0 {
+			return nil, fmt.Errorf("invalid upload_chunk_size %q: expected a size such as 16M", v)
+		}
+		opts.uploadChunkSize = int64(size)
+	}
+
+	if v, ok := popOption(config, "upload_concurrency"); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid upload_concurrency %q: expected a positive integer", v)
+		}
+		opts.uploadConcurrency = n
+	}
+
+	return opts, nil
+}
+
+func popOption(config map[string]string, key string) (string, bool) {
+	v, ok := config[key]
+	if ok {
+		delete(config, key)
+	}
+	return v, ok
+}
@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"fmt"
+	"maps"
+	"sort"
+	"strings"
+)
+
+// overlays lists the rclone backends that can wrap the store remote, in the
+// order they are stacked on it: crypt encrypts the names and content of
+// objects, and chunker splits large objects in chunks, which are then
+// encrypted by crypt. Their options are given with the name of the backend
+// as prefix, e.g. crypt_password or chunker_chunk_size.
+var overlays = []struct {
+	typee    string
+	required []string
+}{
+	{typee: "crypt", required: []string{"password"}},
+	{typee: "chunker"},
+}
+
+// sectionPrefix marks the options of additional rclone remotes the store
+// remote refers to, e.g. section.gdrive.type=drive for a crypt remote whose
+// remote is gdrive:backups.
+const sectionPrefix = "section."
+
+// popSections removes the additional rclone remotes from config and returns
+// their configurations by name.
+func popSections(config map[string]string) (map[string]map[string]string, error) {
+	sections := make(map[string]map[string]string)
+	for key, value := range config {
+		rest, found := strings.CutPrefix(key, sectionPrefix)
+		if !found {
+			continue
+		}
+		name, option, found := strings.Cut(rest, ".")
+		if !found || name == "" || option == "" {
+			return nil, fmt.Errorf("invalid section option %q: expected section.<remote>.<option>", key)
+		}
+		if sections[name] == nil {
+			sections[name] = make(map[string]string)
+		}
+		sections[name][option] = value
+		delete(config, key)
+	}
+
+	for name, section := range sections {
+		if section["type"] == "" {
+			return nil, fmt.Errorf("missing type in configuration of section %s", name)
+		}
+	}
+	return sections, nil
+}
+
+// popOverlays removes the options of the overlays from config and returns
+// them by backend. Overlays without options are not configured.
+func popOverlays(config map[string]string) (map[string]map[string]string, error) {
+	options := make(map[string]map[string]string)
+	for _, overlay := range overlays {
+		for key, value := range config {
+			option, found := strings.CutPrefix(key, overlay.typee+"_")
+			if !found {
+				continue
+			}
+			if options[overlay.typee] == nil {
+				options[overlay.typee] = make(map[string]string)
+			}
+			options[overlay.typee][option] = value
+			delete(config, key)
+		}
+
+		if options[overlay.typee] == nil {
+			continue
+		}
+		for _, option := range overlay.required {
+			if options[overlay.typee][option] == "" {
+				return nil, fmt.Errorf("missing %s_%s in configuration", overlay.typee, option)
+			}
+		}
+	}
+	return options, nil
+}
+
+// wrap makes the store go through a remote of the overlay backend typee
+// wrapping the current one, and so do the sections of its tiers. The type of
+// the remote stays the one of the backend holding the objects.
+func (remote *remoteConfig) wrap(typee string, options map[string]string) error {
+	name := remote.section + "_" + typee
+	if _, found := remote.sections[name]; found {
+		return fmt.Errorf("section %s is reserved for the %s overlay", name, typee)
+	}
+
+	options["type"] = typee
+	for prefix, section := range remote.tierSections {
+		tierName := section + "_" + typee
+		if _, found := remote.sections[tierName]; found {
+			return fmt.Errorf("section %s is reserved for the %s overlay", tierName, typee)
+		}
+		tierOptions := maps.Clone(options)
+		tierOptions["remote"] = section + ":" + remote.root
+		remote.sections[tierName] = tierOptions
+		remote.tierSections[prefix] = tierName
+	}
+	options["remote"] = remote.section + ":" + remote.root
+	remote.sections[name] = options
+
+	remote.section = name
+	remote.root = ""
+	remote.overlays = append(remote.overlays, typee)
+	return nil
+}
+
+// sectionNames returns the names of the rclone sections of remote, the one
+// of the store first.
+func (remote *remoteConfig) sectionNames() []string {
+	names := make([]string, 0, len(remote.sections))
+	for name := range remote.sections {
+		if name != remote.section {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return append([]string{remote.section}, names...)
+}
@@ -0,0 +1,122 @@
+package storage
+
+import (
+	"testing"
+)
+
+func TestPopSections(t *testing.T) {
+	config := map[string]string{
+		"type":                    "crypt",
+		"section.gdrive.type":     "drive",
+		"section.gdrive.token":    "{}",
+		"section.backup.type":     "sftp",
+		"section.backup.host":     "example.com",
+		"section.backup.key_file": "/etc/key",
+	}
+
+	sections, err := popSections(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sections) != 2 || sections["gdrive"]["token"] != "{}" || sections["backup"]["key_file"] != "/etc/key" {
+		t.Errorf("unexpected sections %v", sections)
+	}
+	if len(config) != 1 {
+		t.Errorf("section options left in config: %v", config)
+	}
+}
+
+func TestPopSectionsInvalid(t *testing.T) {
+	for _, config := range []map[string]string{
+		{"section.gdrive": "drive"},
+		{"section..type": "drive"},
+		{"section.gdrive.token": "{}"},
+	} {
+		if _, err := popSections(config); err == nil {
+			t.Errorf("%v accepted", config)
+		}
+	}
+}
+
+func TestPopOverlays(t *testing.T) {
+	config := map[string]string{
+		"type":               "s3",
+		"crypt_password":     "secret",
+		"crypt_password2":    "salt",
+		"chunker_chunk_size": "100M",
+	}
+
+	options, err := popOverlays(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if options["crypt"]["password"] != "secret" || options["crypt"]["password2"] != "salt" {
+		t.Errorf("unexpected crypt options %v", options["crypt"])
+	}
+	if options["chunker"]["chunk_size"] != "100M" {
+		t.Errorf("unexpected chunker options %v", options["chunker"])
+	}
+	if len(config) != 1 {
+		t.Errorf("overlay options left in config: %v", config)
+	}
+
+	if _, err := popOverlays(map[string]string{"crypt_filename_encryption": "base64"}); err == nil {
+		t.Error("crypt accepted without password")
+	}
+
+	options, err = popOverlays(map[string]string{"type": "s3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(options) != 0 {
+		t.Errorf("overlays configured without options: %v", options)
+	}
+}
+
+func TestParseRemoteOverlays(t *testing.T) {
+	remote, err := parseRemote("test", "", map[string]string{
+		"location":           "rclone://bucket/repo",
+		"type":               "s3",
+		"crypt_password":     "secret",
+		"chunker_chunk_size": "100M",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if remote.typee != "s3" {
+		t.Errorf("type is %s, expected the one of the backend", remote.typee)
+	}
+	if len(remote.overlays) != 2 || remote.overlays[0] != "crypt" || remote.overlays[1] != "chunker" {
+		t.Errorf("overlays are %v, expected crypt then chunker", remote.overlays)
+	}
+	if remote.section != "s3_crypt_chunker" || remote.root != "" {
+		t.Errorf("store goes through %s:%s", remote.section, remote.root)
+	}
+
+	for name, expected := range map[string]string{
+		"s3_crypt":         "s3:bucket/repo",
+		"s3_crypt_chunker": "s3_crypt:",
+	} {
+		if remote.sections[name]["remote"] != expected {
+			t.Errorf("section %s wraps %q, expected %q", name, remote.sections[name]["remote"], expected)
+		}
+	}
+
+	names := remote.sectionNames()
+	if len(names) != 3 || names[0] != "s3_crypt_chunker" {
+		t.Errorf("section names %v, expected the one of the store first", names)
+	}
+}
+
+func TestParseRemoteReservedSection(t *testing.T) {
+	_, err := parseRemote("test", "", map[string]string{
+		"location":              "rclone://bucket/repo",
+		"type":                  "s3",
+		"crypt_password":        "secret",
+		"section.s3_crypt.type": "local",
+	})
+	if err == nil {
+		t.Fatal("section of the crypt overlay accepted")
+	}
+}
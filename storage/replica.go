@@ -0,0 +1,646 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	iofs "io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/PlakarKorp/kloset/objects"
+	"github.com/PlakarKorp/kloset/storage"
+	"github.com/rclone/rclone/fs"
+)
+
+// replicaKey matches the configuration keys of additional remotes, e.g.
+// replica1_location or replica2_type.
+var replicaKey = regexp.MustCompile(`^replica(\d+)_(.+)$`)
+
+// replicaRetryAfter is how long a replica that failed is passed over for
+// reads before being tried again.
+const replicaRetryAfter = time.Minute
+
+// popReplicas removes the configuration of the additional remotes from
+// config and returns it in the order of the replica numbers, along with the
+// write quorum.
+func popReplicas(config map[string]string) ([]map[string]string, int, error) {
+	byIndex := make(map[int]map[string]string)
+	for key, value := range config {
+		m := replicaKey.FindStringSubmatch(key)
+		if m == nil {
+			continue
+		}
+		index, err := strconv.Atoi(m[1])
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid replica option %q", key)
+		}
+		if byIndex[index] == nil {
+			byIndex[index] = make(map[string]string)
+		}
+		byIndex[index][m[2]] = value
+		delete(config, key)
+	}
+
+	quorum := 0
+	if v, ok := popOption(config, "write_quorum"); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, 0, fmt.Errorf("invalid write_quorum %q: expected a positive integer", v)
+		}
+		quorum = n
+	}
+
+	indexes := make([]int, 0, len(byIndex))
+	for index := range byIndex {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+
+	replicas := make([]map[string]string, 0, len(indexes))
+	for _, index := range indexes {
+		replicas = append(replicas, byIndex[index])
+	}
+	return replicas, quorum, nil
+}
+
+// ReplicatedStorage is a store backed by several rclone remotes holding the
+// same repository. Writes go to every remote and succeed once the write
+// quorum is reached, reads are served by the fastest healthy remote and
+// listings are the union of the listings of all remotes.
+type ReplicatedStorage struct {
+	replicas []*RcloneStorage
+	quorum   int
+	health   []replicaHealth
+}
+
+type replicaHealth struct {
+	mu          sync.Mutex
+	down        bool
+	latency     time.Duration
+	lastFailure time.Time
+}
+
+func (h *replicaHealth) success(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.latency == 0 {
+		h.latency = d
+	} else {
+		h.latency = (3*h.latency + d) / 4
+	}
+	h.lastFailure = time.Time{}
+}
+
+func (h *replicaHealth) failure() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastFailure = time.Now()
+}
+
+func (h *replicaHealth) state() (down, healthy bool, latency time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.down, h.lastFailure.IsZero() || time.Since(h.lastFailure) > replicaRetryAfter, h.latency
+}
+
+func newReplicatedStorage(replicas []*RcloneStorage, quorum int) (*ReplicatedStorage, error) {
+	if quorum == 0 {
+		quorum = len(replicas)
+	}
+	if quorum > len(replicas) {
+		return nil, fmt.Errorf("write_quorum %d is larger than the number of remotes (%d)", quorum, len(replicas))
+	}
+
+	return &ReplicatedStorage{
+		replicas: replicas,
+		quorum:   quorum,
+		health:   make([]replicaHealth, len(replicas)),
+	}, nil
+}
+
+// Replicas returns the stores of the remotes, the primary one first.
+func (s *ReplicatedStorage) Replicas() []*RcloneStorage {
+	return s.replicas
+}
+
+// byPreference returns the indexes of the replicas that are up, healthy
+// ones first and by increasing latency.
+func (s *ReplicatedStorage) byPreference() []int {
+	type candidate struct {
+		index   int
+		healthy bool
+		latency time.Duration
+	}
+
+	var candidates []candidate
+	for i := range s.replicas {
+		down, healthy, latency := s.health[i].state()
+		if !down {
+			candidates = append(candidates, candidate{i, healthy, latency})
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].healthy != candidates[j].healthy {
+			return candidates[i].healthy
+		}
+		return candidates[i].latency < candidates[j].latency
+	})
+
+	indexes := make([]int, 0, len(candidates))
+	for _, c := range candidates {
+		indexes = append(indexes, c.index)
+	}
+	return indexes
+}
+
+// read runs fn on the preferred replica, falling back to the next ones until
+// it succeeds.
+func (s *ReplicatedStorage) read(fn func(r *RcloneStorage) error) error {
+	var errs []error
+	for _, i := range s.byPreference() {
+		t0 := time.Now()
+		err := fn(s.replicas[i])
+		if err == nil {
+			s.health[i].success(time.Since(t0))
+			return nil
+		}
+		s.health[i].failure()
+		errs = append(errs, fmt.Errorf("%s: %w", s.replicas[i].remote(), err))
+	}
+
+	if len(errs) == 0 {
+		return fmt.Errorf("no replica available")
+	}
+	return errors.Join(errs...)
+}
+
+// write runs fn on every replica concurrently and succeeds if the write
+// quorum is reached.
+func (s *ReplicatedStorage) write(fn func(i int, r *RcloneStorage) error) error {
+	errs := make([]error, len(s.replicas))
+
+	var wg sync.WaitGroup
+	for i, replica := range s.replicas {
+		if down, _, _ := s.health[i].state(); down {
+			errs[i] = fmt.Errorf("replica unavailable")
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			t0 := time.Now()
+			errs[i] = fn(i, replica)
+			if errs[i] == nil {
+				s.health[i].success(time.Since(t0))
+			} else {
+				s.health[i].failure()
+			}
+		}()
+	}
+	wg.Wait()
+
+	succeeded := 0
+	var failures []error
+	for i, err := range errs {
+		if err == nil {
+			succeeded++
+		} else {
+			failures = append(failures, fmt.Errorf("%s: %w", s.replicas[i].remote(), err))
+		}
+	}
+
+	if succeeded < s.quorum {
+		return fmt.Errorf("write quorum not reached (%d/%d): %w", succeeded, s.quorum, errors.Join(failures...))
+	}
+	for _, err := range failures {
+		fs.Logf(nil, "replica write failed: %v", err)
+	}
+	return nil
+}
+
+// put streams rd to every replica at once through fn.
+func (s *ReplicatedStorage) put(rd io.Reader, fn func(r *RcloneStorage, rd io.Reader) (int64, error)) (int64, error) {
+	readers := make([]*io.PipeReader, len(s.replicas))
+	writers := make([]*io.PipeWriter, len(s.replicas))
+	for i := range s.replicas {
+		readers[i], writers[i] = io.Pipe()
+	}
+
+	var size int64
+	var mu sync.Mutex
+	done := make(chan error, 1)
+	go func() {
+		done <- s.write(func(i int, r *RcloneStorage) error {
+			n, err := fn(r, readers[i])
+			// unblock the fan-out if the upload stopped reading early
+			readers[i].CloseWithError(err)
+			if err == nil {
+				mu.Lock()
+				size = n
+				mu.Unlock()
+			}
+			return err
+		})
+	}()
+
+	var dst []io.Writer
+	for i, w := range writers {
+		if down, _, _ := s.health[i].state(); !down {
+			dst = append(dst, w)
+		}
+	}
+	_, err := io.Copy(newFanout(dst), rd)
+	for _, w := range writers {
+		w.CloseWithError(err)
+	}
+
+	if err := <-done; err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// putObject uploads rd to the object named by name on every replica. The
+// replicas read rd in lockstep, so a replica waiting for a transfer slot
+// would hold up the others while they keep theirs: the slots of all the
+// replicas are taken first, always in the same order.
+func (s *ReplicatedStorage) putObject(ctx context.Context, rd io.Reader, name func(r *RcloneStorage) string) (int64, error) {
+	done, err := s.acquireTransfers(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+
+	return s.put(rd, func(r *RcloneStorage, rd io.Reader) (int64, error) {
+		return r.putObject(ctx, name(r), rd)
+	})
+}
+
+// acquireTransfers takes a transfer slot on every replica, in their order,
+// and returns the function releasing them.
+func (s *ReplicatedStorage) acquireTransfers(ctx context.Context) (func(), error) {
+	var dones []func()
+	release := func() {
+		for i := len(dones) - 1; i >= 0; i-- {
+			dones[i]()
+		}
+	}
+
+	for _, replica := range s.replicas {
+		done, err := replica.acquireTransfer(ctx)
+		if err != nil {
+			release()
+			return nil, err
+		}
+		dones = append(dones, done)
+	}
+	return release, nil
+}
+
+// fanout writes to several writers, dropping the ones that fail. It only
+// fails once all of them did.
+type fanout struct {
+	writers []io.Writer
+	failed  []bool
+}
+
+func newFanout(writers []io.Writer) *fanout {
+	return &fanout{writers: writers, failed: make([]bool, len(writers))}
+}
+
+func (f *fanout) Write(p []byte) (int, error) {
+	alive := 0
+	for i, w := range f.writers {
+		if f.failed[i] {
+			continue
+		}
+		if _, err := w.Write(p); err != nil {
+			f.failed[i] = true
+			continue
+		}
+		alive++
+	}
+
+	if alive == 0 {
+		return 0, fmt.Errorf("all replicas failed")
+	}
+	return len(p), nil
+}
+
+// list returns the union of the MACs listed by fn on every replica.
+func (s *ReplicatedStorage) list(fn func(r *RcloneStorage) ([]objects.MAC, error)) ([]objects.MAC, error) {
+	var mu sync.Mutex
+	seen := make(map[objects.MAC]struct{})
+	var macs []objects.MAC
+
+	err := s.write(func(i int, r *RcloneStorage) error {
+		listed, err := fn(r)
+		if err != nil {
+			return err
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		for _, mac := range listed {
+			if _, found := seen[mac]; !found {
+				seen[mac] = struct{}{}
+				macs = append(macs, mac)
+			}
+		}
+		return nil
+	})
+	if err != nil && len(seen) == 0 {
+		return nil, err
+	}
+
+	return macs, nil
+}
+
+func (s *ReplicatedStorage) Create(ctx context.Context, config []byte) error {
+	return s.write(func(i int, r *RcloneStorage) error {
+		return r.Create(ctx, config)
+	})
+}
+
+// Open opens every replica. Replicas that can't be opened are left out for
+// the rest of the session.
+func (s *ReplicatedStorage) Open(ctx context.Context) ([]byte, error) {
+	configs := make([][]byte, len(s.replicas))
+	errs := make([]error, len(s.replicas))
+
+	var wg sync.WaitGroup
+	for i, replica := range s.replicas {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			configs[i], errs[i] = replica.Open(ctx)
+		}()
+	}
+	wg.Wait()
+
+	var config []byte
+	var failures []error
+	for i, err := range errs {
+		if err != nil {
+			s.health[i].mu.Lock()
+			s.health[i].down = true
+			s.health[i].mu.Unlock()
+			failures = append(failures, fmt.Errorf("%s: %w", s.replicas[i].remote(), err))
+			fs.Logf(nil, "replica %s left out: %v", s.replicas[i].remote(), err)
+			continue
+		}
+		if config == nil {
+			config = configs[i]
+		}
+	}
+
+	if config == nil {
+		return nil, errors.Join(failures...)
+	}
+	return config, nil
+}
+
+func (s *ReplicatedStorage) Location(ctx context.Context) (string, error) {
+	return s.replicas[0].Location(ctx)
+}
+
+func (s *ReplicatedStorage) Mode(ctx context.Context) (storage.Mode, error) {
+	mode := storage.ModeRead | storage.ModeWrite
+	for i, replica := range s.replicas {
+		if down, _, _ := s.health[i].state(); down {
+			continue
+		}
+		m, err := replica.Mode(ctx)
+		if err != nil {
+			return 0, err
+		}
+		mode &= m
+	}
+	return mode, nil
+}
+
+func (s *ReplicatedStorage) Size(ctx context.Context) (int64, error) {
+	var size int64
+	err := s.read(func(r *RcloneStorage) error {
+		var err error
+		size, err = r.Size(ctx)
+		return err
+	})
+	return size, err
+}
+
+func (s *ReplicatedStorage) GetStates(ctx context.Context) ([]objects.MAC, error) {
+	return s.list(func(r *RcloneStorage) ([]objects.MAC, error) {
+		return r.GetStates(ctx)
+	})
+}
+
+func (s *ReplicatedStorage) PutState(ctx context.Context, mac objects.MAC, rd io.Reader) (int64, error) {
+	return s.putObject(ctx, rd, func(r *RcloneStorage) string {
+		return r.objectPath("states", mac)
+	})
+}
+
+func (s *ReplicatedStorage) GetState(ctx context.Context, mac objects.MAC) (io.ReadCloser, error) {
+	var rd io.ReadCloser
+	err := s.read(func(r *RcloneStorage) error {
+		var err error
+		rd, err = r.GetState(ctx, mac)
+		return err
+	})
+	return rd, err
+}
+
+func (s *ReplicatedStorage) DeleteState(ctx context.Context, mac objects.MAC) error {
+	return s.write(func(i int, r *RcloneStorage) error {
+		return r.DeleteState(ctx, mac)
+	})
+}
+
+func (s *ReplicatedStorage) GetPackfiles(ctx context.Context) ([]objects.MAC, error) {
+	return s.list(func(r *RcloneStorage) ([]objects.MAC, error) {
+		return r.GetPackfiles(ctx)
+	})
+}
+
+func (s *ReplicatedStorage) PutPackfile(ctx context.Context, mac objects.MAC, rd io.Reader) (int64, error) {
+	return s.putObject(ctx, rd, func(r *RcloneStorage) string {
+		return r.objectPath("packfiles", mac)
+	})
+}
+
+func (s *ReplicatedStorage) GetPackfile(ctx context.Context, mac objects.MAC) (io.ReadCloser, error) {
+	var rd io.ReadCloser
+	err := s.read(func(r *RcloneStorage) error {
+		var err error
+		rd, err = r.GetPackfile(ctx, mac)
+		return err
+	})
+	return rd, err
+}
+
+func (s *ReplicatedStorage) GetPackfileBlob(ctx context.Context, mac objects.MAC, offset uint64, length uint32) (io.ReadCloser, error) {
+	var rd io.ReadCloser
+	err := s.read(func(r *RcloneStorage) error {
+		var err error
+		rd, err = r.GetPackfileBlob(ctx, mac, offset, length)
+		return err
+	})
+	return rd, err
+}
+
+func (s *ReplicatedStorage) DeletePackfile(ctx context.Context, mac objects.MAC) error {
+	return s.write(func(i int, r *RcloneStorage) error {
+		return r.DeletePackfile(ctx, mac)
+	})
+}
+
+func (s *ReplicatedStorage) GetLocks(ctx context.Context) ([]objects.MAC, error) {
+	return s.list(func(r *RcloneStorage) ([]objects.MAC, error) {
+		return r.GetLocks(ctx)
+	})
+}
+
+func (s *ReplicatedStorage) PutLock(ctx context.Context, lockID objects.MAC, rd io.Reader) (int64, error) {
+	return s.put(rd, func(r *RcloneStorage, rd io.Reader) (int64, error) {
+		return r.PutLock(ctx, lockID, rd)
+	})
+}
+
+func (s *ReplicatedStorage) GetLock(ctx context.Context, lockID objects.MAC) (io.ReadCloser, error) {
+	var rd io.ReadCloser
+	err := s.read(func(r *RcloneStorage) error {
+		var err error
+		rd, err = r.GetLock(ctx, lockID)
+		return err
+	})
+	return rd, err
+}
+
+func (s *ReplicatedStorage) DeleteLock(ctx context.Context, lockID objects.MAC) error {
+	return s.write(func(i int, r *RcloneStorage) error {
+		return r.DeleteLock(ctx, lockID)
+	})
+}
+
+func (s *ReplicatedStorage) Close(ctx context.Context) error {
+	var errs []error
+	for _, replica := range s.replicas {
+		if err := replica.Close(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ResyncReport is the result of Resync.
+type ResyncReport struct {
+	// Copied counts the objects copied to each remote.
+	Copied map[string]int `json:"copied"`
+	Failed []string       `json:"failed"`
+}
+
+// Resync copies the states and packfiles missing on a replica from another
+// one holding them, creating the repository on replicas lacking it or whose
+// creation was interrupted. Replicas that fail to open for another reason
+// are reported and left out.
+func (s *ReplicatedStorage) Resync(ctx context.Context) (*ResyncReport, error) {
+	report := &ResyncReport{
+		Copied: make(map[string]int),
+		Failed: []string{},
+	}
+
+	var config []byte
+	var missing []int
+	var available []int
+	for i, replica := range s.replicas {
+		data, err := replica.Open(ctx)
+		if errors.Is(err, iofs.ErrNotExist) || errors.Is(err, ErrIncomplete) {
+			missing = append(missing, i)
+			continue
+		} else if err != nil {
+			report.Failed = append(report.Failed, fmt.Sprintf("%s: %v", replica.remote(), err))
+			continue
+		}
+		available = append(available, i)
+		if config == nil {
+			config = data
+		}
+	}
+	if config == nil {
+		return nil, fmt.Errorf("no replica holds the repository")
+	}
+
+	for _, i := range missing {
+		replica := s.replicas[i]
+		if err := replica.Create(ctx, config); err != nil {
+			return nil, fmt.Errorf("failed to create repository on %s: %w", replica.remote(), err)
+		}
+		report.Copied[replica.remote()]++
+		available = append(available, i)
+	}
+	sort.Ints(available)
+
+	for _, dir := range []string{"states", "packfiles"} {
+		holders := make(map[objects.MAC][]int)
+		for _, i := range available {
+			replica := s.replicas[i]
+			macs, err := replica.getMacs(ctx, dir)
+			if err != nil {
+				return nil, fmt.Errorf("failed to list %s on %s: %w", dir, replica.remote(), err)
+			}
+			for _, mac := range macs {
+				holders[mac] = append(holders[mac], i)
+			}
+		}
+
+		for mac, holding := range holders {
+			if len(holding) == len(available) {
+				continue
+			}
+
+			src := s.replicas[holding[0]]
+			for _, i := range available {
+				if contains(holding, i) {
+					continue
+				}
+				dst := s.replicas[i]
+				if err := copyObject(ctx, src, dst, dir, mac); err != nil {
+					report.Failed = append(report.Failed, fmt.Sprintf("%s/%064x to %s: %v", dir, mac, dst.remote(), err))
+					continue
+				}
+				report.Copied[dst.remote()]++
+			}
+		}
+	}
+
+	return report, nil
+}
+
+func contains(indexes []int, i int) bool {
+	for _, index := range indexes {
+		if index == i {
+			return true
+		}
+	}
+	return false
+}
+
+// copyObject streams the object mac of dir from src to dst.
+func copyObject(ctx context.Context, src, dst *RcloneStorage, dir string, mac objects.MAC) error {
+	rd, err := src.getObject(ctx, dir, mac)
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+
+	_, err = dst.putRetained(ctx, dst.objectPath(dir, mac), rd)
+	return err
+}
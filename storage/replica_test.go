@@ -0,0 +1,159 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+func TestPopReplicas(t *testing.T) {
+	config := map[string]string{
+		"location":           "rclone://a",
+		"type":               "drive",
+		"replica2_location":  "rclone://c",
+		"replica2_type":      "sftp",
+		"replica10_location": "rclone://d",
+		"replica10_type":     "s3",
+		"replica1_location":  "rclone://b",
+		"replica1_type":      "local",
+		"write_quorum":       "2",
+	}
+
+	replicas, quorum, err := popReplicas(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if quorum != 2 {
+		t.Errorf("quorum is %d, expected 2", quorum)
+	}
+	if len(replicas) != 3 {
+		t.Fatalf("got %d replicas, expected 3", len(replicas))
+	}
+	for i, expected := range []string{"local", "sftp", "s3"} {
+		if replicas[i]["type"] != expected {
+			t.Errorf("replica %d is of type %s, expected %s", i, replicas[i]["type"], expected)
+		}
+	}
+	if len(config) != 2 || config["type"] != "drive" {
+		t.Errorf("replica options left in config: %v", config)
+	}
+}
+
+func TestPopReplicasInvalidQuorum(t *testing.T) {
+	for _, quorum := range []string{"0", "-1", "all"} {
+		if _, _, err := popReplicas(map[string]string{"write_quorum": quorum}); err == nil {
+			t.Errorf("write_quorum=%s accepted", quorum)
+		}
+	}
+}
+
+// failingWriter fails every write after the first n bytes.
+type failingWriter struct {
+	bytes.Buffer
+	n int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.Len()+len(p) > w.n {
+		return 0, errors.New("write failed")
+	}
+	return w.Buffer.Write(p)
+}
+
+func TestFanout(t *testing.T) {
+	var a, b bytes.Buffer
+	failing := &failingWriter{n: 4}
+
+	f := newFanout([]io.Writer{&a, failing, &b})
+	for _, chunk := range []string{"abcd", "efgh"} {
+		if _, err := f.Write([]byte(chunk)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if a.String() != "abcdefgh" || b.String() != "abcdefgh" {
+		t.Errorf("writers got %q and %q, expected all the data", a.String(), b.String())
+	}
+	if failing.String() != "abcd" {
+		t.Errorf("failed writer got %q, expected the data before it failed", failing.String())
+	}
+	if !f.failed[1] {
+		t.Error("failed writer not dropped")
+	}
+}
+
+func TestFanoutAllFailed(t *testing.T) {
+	f := newFanout([]io.Writer{&failingWriter{}, &failingWriter{}})
+	if _, err := f.Write([]byte("data")); err == nil {
+		t.Fatal("write succeeded with every writer failing")
+	}
+}
+
+func TestResync(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	primary := newLocalStore(t, filepath.Join(dir, "a"), nil)
+	if err := primary.Create(ctx, []byte("config")); err != nil {
+		t.Fatal(err)
+	}
+	var mac objects.MAC
+	mac[0] = 1
+	if _, err := primary.PutPackfile(ctx, mac, strings.NewReader("data")); err != nil {
+		t.Fatal(err)
+	}
+	primary.Close(ctx)
+
+	// the third replica sits below a file and can't be opened
+	if err := os.WriteFile(filepath.Join(dir, "file"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewRcloneStorage(ctx, "test", map[string]string{
+		"location":          "rclone://" + filepath.Join(dir, "a"),
+		"type":              "local",
+		"replica1_location": "rclone://" + filepath.Join(dir, "b"),
+		"replica1_type":     "local",
+		"replica2_location": "rclone://" + filepath.Join(dir, "file", "c"),
+		"replica2_type":     "local",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	replicated := store.(*ReplicatedStorage)
+	defer replicated.Close(ctx)
+
+	report, err := replicated.Resync(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	created := replicated.replicas[1]
+	if report.Copied[created.remote()] != 2 {
+		t.Errorf("copied %v, expected CONFIG and the packfile on %s", report.Copied, created.remote())
+	}
+	if len(report.Failed) != 1 || !strings.HasPrefix(report.Failed[0], replicated.replicas[2].remote()) {
+		t.Errorf("failures %v, expected the replica that can't be opened", report.Failed)
+	}
+
+	config, err := created.Open(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(config) != "config" {
+		t.Errorf("created replica has config %q", config)
+	}
+	macs, err := created.GetPackfiles(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(macs) != 1 || macs[0] != mac {
+		t.Errorf("created replica has packfiles %x", macs)
+	}
+}
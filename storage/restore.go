@@ -0,0 +1,265 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/PlakarKorp/integration-rclone/utils"
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/filter"
+)
+
+const (
+	// restoreFail fails reads of archived objects without restoring them
+	restoreFail = "fail"
+
+	// restoreRequest requests the restore of archived objects and fails the
+	// read, which can be retried once the restore completes
+	restoreRequest = "request"
+
+	// restoreWait requests the restore of archived objects and waits for it
+	// to complete before serving the read
+	restoreWait = "wait"
+)
+
+// restoreArchived is called when reading the object name failed with err.
+// If the object is archived, it is restored according to the configured
+// policy. It returns nil once the object has been restored and the read can
+// be retried, or the error to report to the caller.
+func (r *RcloneStorage) restoreArchived(ctx context.Context, name string, err error) error {
+	tier, archived := r.archiveTier(ctx, name)
+	if !archived {
+		return err
+	}
+
+	restored, inProgress, serr := r.restoreStatus(ctx, name)
+	if serr == nil && restored {
+		// a restored copy is available, the read failed for another reason
+		return err
+	}
+
+	if r.opts.restorePolicy == restoreFail {
+		return fmt.Errorf("%s: %w in tier %s and must be restored first", name, ErrArchived, tier)
+	}
+
+	if !inProgress {
+		if err := r.requestRestore(ctx, name); err != nil {
+			return fmt.Errorf("%s: %w in tier %s and its restore failed: %w", name, ErrArchived, tier, err)
+		}
+	}
+
+	eta := restoreETA(tier, r.opts.restorePriority)
+	if r.opts.restorePolicy == restoreRequest {
+		return fmt.Errorf("%s: %w in tier %s, restore requested, expected to complete within %s", name, ErrArchived, tier, eta)
+	}
+
+	return r.waitRestore(ctx, name, tier, eta)
+}
+
+// waitRestore polls the restore status of the object name until it has been
+// restored or archive_restore_timeout expires.
+func (r *RcloneStorage) waitRestore(ctx context.Context, name, tier string, eta time.Duration) error {
+	start := time.Now()
+	deadline := start.Add(r.opts.restoreTimeout)
+
+	for {
+		restored, _, err := r.restoreStatus(ctx, name)
+		if err != nil {
+			return fmt.Errorf("failed to get restore status of %s: %w", name, err)
+		}
+		if restored {
+			fs.Logf(nil, "restored %s from tier %s in %s", name, tier, time.Since(start).Round(time.Second))
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s: %w in tier %s, restore still in progress after %s", name, ErrArchived, tier, r.opts.restoreTimeout)
+		}
+
+		elapsed := time.Since(start)
+		remaining := eta - elapsed
+		if remaining > 0 {
+			fs.Logf(nil, "restoring %s from tier %s: %s elapsed, about %s remaining", name, tier, elapsed.Round(time.Second), remaining.Round(time.Minute))
+		} else {
+			fs.Logf(nil, "restoring %s from tier %s: %s elapsed, taking longer than the expected %s", name, tier, elapsed.Round(time.Second), eta)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(r.opts.restorePollInterval):
+		}
+	}
+}
+
+// archivedObject returns the object of the backend holding the archived
+// object name, under the overlays of the store. Objects split by chunker
+// are archived as several objects and can't be restored.
+func (r *RcloneStorage) archivedObject(ctx context.Context, name string) (fs.Object, error) {
+	f, err := r.fs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	obj, err := f.NewObject(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat file: %w", utils.TranslateError(r.remotePath(name), err))
+	}
+
+	// chunker is the outermost overlay and its object unwraps to the first
+	// chunk
+	if slices.Contains(r.overlays, "chunker") {
+		if unwrapper, ok := obj.(fs.ObjectUnWrapper); ok {
+			if chunk := unwrapper.UnWrap(); chunk != nil && chunk.Size() != obj.Size() {
+				return nil, fmt.Errorf("%s is split in chunks, which must be restored one by one", name)
+			}
+		}
+	}
+
+	if base := fs.UnWrapObject(obj); base != nil {
+		return base, nil
+	}
+	return obj, nil
+}
+
+// requestRestore asks the provider to make the archived object name
+// readable again: through the restore command of the s3 backend, and by
+// moving the object back to a hot tier elsewhere.
+func (r *RcloneStorage) requestRestore(ctx context.Context, name string) error {
+	obj, err := r.archivedObject(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	if r.Typee != "s3" {
+		setter, ok := obj.(fs.SetTierer)
+		if !ok {
+			return fmt.Errorf("remote %s cannot restore archived objects", r.remote())
+		}
+		err = setter.SetTier(r.opts.restoreTier)
+		if err != nil && strings.Contains(err.Error(), "BlobBeingRehydrated") {
+			return nil
+		}
+		return err
+	}
+
+	f, err := r.fs(ctx)
+	if err != nil {
+		return err
+	}
+	base := fs.UnWrapFs(f)
+	command := base.Features().Command
+	if command == nil {
+		return fmt.Errorf("remote %s cannot restore archived objects", r.remote())
+	}
+
+	// restrict the command to the object, which is then looked up directly
+	// instead of listing the remote
+	fi, err := filter.NewFilter(nil)
+	if err != nil {
+		return err
+	}
+	if err := fi.AddFile(obj.Remote()); err != nil {
+		return err
+	}
+	ctx = filter.ReplaceConfig(ctx, fi)
+	ctx, ci := fs.AddConfig(ctx)
+	ci.NoTraverse = true
+
+	out, err := command(ctx, "restore", nil, map[string]string{
+		"priority": r.opts.restorePriority,
+		"lifetime": strconv.Itoa(r.opts.restoreDays),
+	})
+	if err != nil {
+		return utils.TranslateError(r.remotePath(name), err)
+	}
+
+	var statuses []struct {
+		Status string
+		Remote string
+	}
+	if err := reshape(out, &statuses); err != nil {
+		return err
+	}
+	for _, status := range statuses {
+		if status.Remote != obj.Remote() {
+			continue
+		}
+		if status.Status != "OK" && !strings.Contains(status.Status, "RestoreAlreadyInProgress") {
+			return fmt.Errorf("%s", status.Status)
+		}
+		return nil
+	}
+	return fmt.Errorf("%s not found by the restore command", name)
+}
+
+// restoreStatus reports whether the archived object name has been restored,
+// or whether its restore is in progress. On s3, whose restore-status command
+// lists whole folders, the object is restored once its first byte can be
+// read, and a restore in progress is not told apart from a missing one.
+func (r *RcloneStorage) restoreStatus(ctx context.Context, name string) (restored, inProgress bool, err error) {
+	if r.Typee != "s3" {
+		_, archived := r.archiveTier(ctx, name)
+		return !archived, false, nil
+	}
+
+	obj, err := r.archivedObject(ctx, name)
+	if err != nil {
+		return false, false, err
+	}
+	if obj.Size() == 0 {
+		return true, false, nil
+	}
+
+	rd, err := obj.Open(ctx, &fs.RangeOption{Start: 0, End: 0})
+	if err != nil {
+		if isNotRestored(err) {
+			return false, false, nil
+		}
+		return false, false, utils.TranslateError(r.remotePath(name), err)
+	}
+	rd.Close()
+	return true, false, nil
+}
+
+// isNotRestored reports whether err is the failure of a read of an archived
+// s3 object that has not been restored.
+func isNotRestored(err error) bool {
+	message := err.Error()
+	return strings.Contains(message, "InvalidObjectState") || strings.Contains(message, "restore first")
+}
+
+// reshape converts the output of a backend command to out.
+func reshape(in any, out any) error {
+	data, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
+
+// restoreETA returns the typical duration of a restore from tier with the
+// given priority, as documented by the providers.
+func restoreETA(tier, priority string) time.Duration {
+	switch strings.ToUpper(tier) {
+	case "GLACIER":
+		switch priority {
+		case "Expedited":
+			return 5 * time.Minute
+		case "Bulk":
+			return 12 * time.Hour
+		}
+		return 5 * time.Hour
+	case "DEEP_ARCHIVE":
+		if priority == "Bulk" {
+			return 48 * time.Hour
+		}
+		return 12 * time.Hour
+	}
+	return 15 * time.Hour
+}
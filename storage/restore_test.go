@@ -0,0 +1,37 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestIsNotRestored(t *testing.T) {
+	for message, expected := range map[string]bool{
+		`Object in GLACIER, restore first: bucket="b", key="k"`:                         true,
+		"InvalidObjectState: The operation is not valid for the object's storage class": true,
+		"AccessDenied: Access Denied":                                                   false,
+	} {
+		if got := isNotRestored(errors.New(message)); got != expected {
+			t.Errorf("isNotRestored(%q) = %v, expected %v", message, got, expected)
+		}
+	}
+}
+
+func TestRestoreETA(t *testing.T) {
+	for _, test := range []struct {
+		tier, priority string
+		expected       time.Duration
+	}{
+		{"GLACIER", "Expedited", 5 * time.Minute},
+		{"GLACIER", "Standard", 5 * time.Hour},
+		{"GLACIER", "Bulk", 12 * time.Hour},
+		{"DEEP_ARCHIVE", "Standard", 12 * time.Hour},
+		{"DEEP_ARCHIVE", "Bulk", 48 * time.Hour},
+		{"Archive", "Standard", 15 * time.Hour},
+	} {
+		if got := restoreETA(test.tier, test.priority); got != test.expected {
+			t.Errorf("restoreETA(%q, %q) = %s, expected %s", test.tier, test.priority, got, test.expected)
+		}
+	}
+}
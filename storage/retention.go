@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// ErrRetentionActive is returned when deleting an object protected by an
+// object-lock retention that hasn't expired yet.
+var ErrRetentionActive = errors.New("retention active")
+
+// retention applies S3 object-lock retention to the objects of the
+// repository. rclone doesn't expose object lock, so this talks to the S3 API
+// directly. The bucket must have object lock enabled.
+type retention struct {
+	*s3Client
+	mode   types.ObjectLockRetentionMode
+	period time.Duration
+}
+
+func newRetention(typee string, client *s3Client, opts *options) (*retention, error) {
+	if typee != "s3" || client == nil {
+		return nil, fmt.Errorf("retention is only supported on s3 remotes, not %s", typee)
+	}
+
+	return &retention{
+		s3Client: client,
+		mode:     types.ObjectLockRetentionMode(strings.ToUpper(opts.retentionMode)),
+		period:   opts.retentionPeriod,
+	}, nil
+}
+
+// apply sets the retention of the object name to the configured period.
+func (rt *retention) apply(ctx context.Context, name string) error {
+	_, err := rt.client.PutObjectRetention(ctx, &s3.PutObjectRetentionInput{
+		Bucket: aws.String(rt.bucket),
+		Key:    aws.String(rt.key(name)),
+		Retention: &types.ObjectLockRetention{
+			Mode:            rt.mode,
+			RetainUntilDate: aws.Time(time.Now().Add(rt.period)),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set retention on %s: %w", name, err)
+	}
+	return nil
+}
+
+// check returns an error wrapping ErrRetentionActive if the object name is
+// still under retention.
+func (rt *retention) check(ctx context.Context, name string) error {
+	out, err := rt.client.GetObjectRetention(ctx, &s3.GetObjectRetentionInput{
+		Bucket: aws.String(rt.bucket),
+		Key:    aws.String(rt.key(name)),
+	})
+	if err != nil {
+		// a missing object has nothing to protect, its deletion reports it
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) {
+			switch apiErr.ErrorCode() {
+			case "NoSuchObjectLockConfiguration", "NoSuchKey", "NotFound":
+				return nil
+			}
+		}
+		return fmt.Errorf("failed to get retention of %s: %w", name, err)
+	}
+
+	if out.Retention == nil || out.Retention.RetainUntilDate == nil {
+		return nil
+	}
+	until := *out.Retention.RetainUntilDate
+	if time.Now().Before(until) {
+		return fmt.Errorf("cannot delete %s: %w until %s", name, ErrRetentionActive, until.Format(time.RFC3339))
+	}
+	return nil
+}
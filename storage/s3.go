@@ -0,0 +1,72 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// s3Client talks to the S3 API of an s3 remote directly, for the features
+// rclone doesn't expose, using the credentials of the rclone remote.
+type s3Client struct {
+	client *s3.Client
+	bucket string
+	prefix string
+}
+
+func newS3Client(ctx context.Context, base string, config map[string]string) (*s3Client, error) {
+	bucket, prefix, _ := strings.Cut(strings.Trim(base, "/"), "/")
+	if bucket == "" {
+		return nil, fmt.Errorf("missing bucket in the location")
+	}
+
+	var loadOpts []func(*awsconfig.LoadOptions) error
+	region := config["region"]
+	if region == "" {
+		region = "us-east-1"
+	}
+	loadOpts = append(loadOpts, awsconfig.WithRegion(region))
+	if config["access_key_id"] != "" {
+		loadOpts = append(loadOpts, awsconfig.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(
+			config["access_key_id"], config["secret_access_key"], config["session_token"])))
+	}
+
+	awsCfg, err := awsconfig.LoadDefaultConfig(ctx, loadOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure s3 client: %w", err)
+	}
+
+	// rclone uses path-style requests unless told otherwise
+	pathStyle := true
+	if v, ok := config["force_path_style"]; ok {
+		pathStyle, _ = strconv.ParseBool(v)
+	}
+
+	client := s3.NewFromConfig(awsCfg, func(o *s3.Options) {
+		if endpoint := config["endpoint"]; endpoint != "" {
+			if !strings.Contains(endpoint, "://") {
+				endpoint = "https://" + endpoint
+			}
+			o.BaseEndpoint = aws.String(endpoint)
+		}
+		o.UsePathStyle = pathStyle
+	})
+
+	return &s3Client{
+		client: client,
+		bucket: bucket,
+		prefix: prefix,
+	}, nil
+}
+
+// key returns the S3 key of the object name of the repository.
+func (c *s3Client) key(name string) string {
+	return path.Join(c.prefix, name)
+}
@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// sizeCache remembers the last computed repository size so that repeated
+// calls to Size don't relist the whole remote.
+type sizeCache struct {
+	mu       sync.Mutex
+	size     int64
+	computed time.Time
+}
+
+func (r *RcloneStorage) Size(ctx context.Context) (int64, error) {
+	r.size.mu.Lock()
+	defer r.size.mu.Unlock()
+
+	if !r.size.computed.IsZero() && time.Since(r.size.computed) < r.opts.sizeCacheTTL {
+		return r.size.size, nil
+	}
+
+	var size int64
+	var err error
+	if r.opts.sizeMode == "about" {
+		size, err = r.aboutSize(ctx)
+		if err != nil {
+			// the backend doesn't expose its usage, count the objects instead
+			size, err = r.listSize(ctx)
+		}
+	} else {
+		size, err = r.listSize(ctx)
+	}
+	if err != nil {
+		return -1, err
+	}
+
+	r.size.size = size
+	r.size.computed = time.Now()
+	return size, nil
+}
+
+// listSize sums the size of every object below the repository folders.
+func (r *RcloneStorage) listSize(ctx context.Context) (int64, error) {
+	var total int64
+	for _, dir := range []string{"states", "packfiles", "locks"} {
+		payload := map[string]any{
+			"fs": r.remotePath(dir),
+		}
+
+		body, err := r.opts.retry.RPC(ctx, "operations/size", payload)
+		if err != nil {
+			return -1, fmt.Errorf("failed to compute size of %s: %w", dir, err)
+		}
+
+		var response struct {
+			Bytes int64 `json:"bytes"`
+		}
+		if err := json.Unmarshal([]byte(body), &response); err != nil {
+			return -1, fmt.Errorf("failed to parse response: %w", err)
+		}
+
+		total += response.Bytes
+	}
+
+	return total, nil
+}
+
+// aboutSize returns the space used on the remote as reported by the provider.
+// This is the usage of the whole account, not only of the repository.
+func (r *RcloneStorage) aboutSize(ctx context.Context) (int64, error) {
+	payload := map[string]any{
+		"fs": r.remote(),
+	}
+
+	body, err := r.opts.retry.RPC(ctx, "operations/about", payload)
+	if err != nil {
+		return -1, fmt.Errorf("failed to get remote usage: %w", err)
+	}
+
+	var response struct {
+		Used *int64 `json:"used"`
+	}
+	if err := json.Unmarshal([]byte(body), &response); err != nil {
+		return -1, fmt.Errorf("failed to parse response: %w", err)
+	}
+	if response.Used == nil {
+		return -1, fmt.Errorf("remote %s does not report its usage", r.remote())
+	}
+
+	return *response.Used, nil
+}
@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// stagingDir holds objects while they are being uploaded. They are renamed
+// to their final name only once the upload is complete.
+const stagingDir = "tmp"
+
+func stagingPath(name string) string {
+	return fmt.Sprintf("%s/%s.%s", stagingDir, path.Base(name), randomSuffix())
+}
+
+func randomSuffix() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// canStage reports whether uploads to f should go through a staging name,
+// which is only worth it when the backend can rename objects server-side.
+// Bucket-based backends only copy objects, and their uploads are atomic
+// already.
+func (r *RcloneStorage) canStage(f fs.Fs) bool {
+	if !r.opts.atomicUploads {
+		return false
+	}
+	return f.Features().Move != nil
+}
+
+// cleanupStaging removes the staging objects left behind by interrupted
+// uploads. Objects younger than stagingMaxAge may belong to an upload still
+// in progress on another host and are kept.
+func (r *RcloneStorage) cleanupStaging(ctx context.Context) {
+	f, err := r.fs(ctx)
+	if err != nil {
+		return
+	}
+
+	entries, err := f.List(ctx, stagingDir)
+	if errors.Is(err, fs.ErrorDirNotFound) {
+		return
+	} else if err != nil {
+		fs.Logf(f, "failed to list staging objects: %v", err)
+		return
+	}
+
+	for _, entry := range entries {
+		obj, ok := entry.(fs.Object)
+		if !ok {
+			continue
+		}
+		if time.Since(obj.ModTime(ctx)) < r.opts.stagingMaxAge {
+			continue
+		}
+		if err := obj.Remove(ctx); err != nil {
+			fs.Logf(obj, "failed to remove stale staging object: %v", err)
+		}
+	}
+}
@@ -5,18 +5,26 @@ import (
 	"context"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"net/http"
+	iofs "io/fs"
 	"os"
 	"path"
 	"strings"
+	"time"
 
 	"github.com/PlakarKorp/integration-rclone/utils"
 	"github.com/PlakarKorp/kloset/objects"
 	"github.com/PlakarKorp/kloset/storage"
 	_ "github.com/rclone/rclone/backend/all" // import all backends
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/cache"
+	"github.com/rclone/rclone/fs/fserrors"
+	"github.com/rclone/rclone/fs/operations"
+	"github.com/rclone/rclone/lib/readers"
 	"github.com/rclone/rclone/librclone/librclone"
+	"golang.org/x/sync/semaphore"
 )
 
 type RcloneStorage struct {
@@ -25,9 +33,91 @@ type RcloneStorage struct {
 	confFile *os.File
 
 	location string
+	section  string
+	root     string
+	overlays []string
+	opts     *options
+	mode     string
+	layout   string
+	size     sizeCache
+	foreign  foreignEntries
+	cache    *diskCache
+
+	// tierSections maps the prefixes given a tier to the section their
+	// objects are uploaded through
+	tierSections map[string]string
+
+	// transfers bounds the concurrent state and packfile transfers
+	transfers *semaphore.Weighted
+
+	// s3 is set on s3 remotes, for the features rclone doesn't expose
+	s3        *s3Client
+	locks     conditionalLocks
+	retention *retention
+}
+
+// remoteConfig is the configuration of one rclone remote backing the store.
+type remoteConfig struct {
+	location string
+	base     string
+	section  string
+	root     string
+	typee    string
+	config   map[string]string
+	opts     *options
+
+	// overlays lists the rclone backends wrapping the remote, innermost
+	// first
+	overlays []string
+
+	// sections holds the rclone sections to write for the remote by name,
+	// including section itself
+	sections map[string]map[string]string
+
+	// tierSections maps the prefixes given a tier to the section their
+	// objects are uploaded through
+	tierSections map[string]string
 }
 
 func NewRcloneStorage(ctx context.Context, name string, config map[string]string) (storage.Store, error) {
+	replicaConfigs, quorum, err := popReplicas(config)
+	if err != nil {
+		return nil, err
+	}
+
+	primary, err := parseRemote(name, "", config)
+	if err != nil {
+		return nil, err
+	}
+
+	var replicas []*remoteConfig
+	for i, replicaConfig := range replicaConfigs {
+		replica, err := parseRemote(name, fmt.Sprintf("replica%d", i+1), replicaConfig)
+		if err != nil {
+			return nil, err
+		}
+		replicas = append(replicas, replica)
+	}
+
+	stores, err := newStores(ctx, append([]*remoteConfig{primary}, replicas...))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(stores) == 1 {
+		return stores[0], nil
+	}
+
+	replicated, err := newReplicatedStorage(stores, quorum)
+	if err != nil {
+		return nil, err
+	}
+	return replicated, nil
+}
+
+// parseRemote extracts the remote described by config. The rclone section
+// of the remote is named after its type unless section is given.
+func parseRemote(name, section string, config map[string]string) (*remoteConfig, error) {
 	location, base, found := strings.Cut(config["location"], "://")
 	if !found {
 		return nil, fmt.Errorf("invalid location: %s. Expected format: location: <provider>://", config["location"])
@@ -35,47 +125,318 @@ func NewRcloneStorage(ctx context.Context, name string, config map[string]string
 
 	utils.CleanPlakarRcloneConf(config)
 
+	sections, err := popSections(config)
+	if err != nil {
+		return nil, err
+	}
+
+	overlayOptions, err := popOverlays(config)
+	if err != nil {
+		return nil, err
+	}
+
+	opts, err := parseOptions(config)
+	if err != nil {
+		return nil, err
+	}
+
 	typee, found := config["type"]
 	if !found {
 		return nil, fmt.Errorf("missing type in configuration for %s", name)
 	}
 
-	file, err := utils.WriteRcloneConfigFile(typee, config)
-	if err != nil {
+	if err := setBackendOptions(typee, config, opts); err != nil {
+		return nil, err
+	}
+
+	if section == "" {
+		section = typee
+	}
+	if _, found := sections[section]; found {
+		return nil, fmt.Errorf("section %s is already the remote of %s", section, name)
+	}
+	sections[section] = config
+
+	remote := &remoteConfig{
+		location: location,
+		base:     base,
+		section:  section,
+		root:     base,
+		typee:    typee,
+		config:   config,
+		opts:     opts,
+		sections: sections,
+
+		tierSections: make(map[string]string),
+	}
+	if err := remote.addTierSections(); err != nil {
 		return nil, err
 	}
+	for _, overlay := range overlays {
+		if options, found := overlayOptions[overlay.typee]; found {
+			if err := remote.wrap(overlay.typee, options); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return remote, nil
+}
+
+// newStores writes the rclone configuration of remotes and builds their
+// stores. The first store owns the configuration file.
+func newStores(ctx context.Context, remotes []*remoteConfig) ([]*RcloneStorage, error) {
+	written := make(map[string]bool)
+	for _, remote := range remotes {
+		for name := range remote.sections {
+			if written[name] {
+				return nil, fmt.Errorf("section %s is defined more than once", name)
+			}
+			written[name] = true
+		}
+	}
+
+	var file *os.File
+	for _, remote := range remotes {
+		for _, name := range remote.sectionNames() {
+			var err error
+			if file == nil {
+				file, err = utils.WriteRcloneConfigFile(name, remote.sections[name])
+			} else {
+				err = utils.WriteRcloneConfigSection(file, name, remote.sections[name])
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
 
 	librclone.Initialize()
 
+	var stores []*RcloneStorage
+	for _, remote := range remotes {
+		store, err := newStore(ctx, remote)
+		if err != nil {
+			return nil, err
+		}
+		stores = append(stores, store)
+	}
+	stores[0].confFile = file
+
+	return stores, nil
+}
+
+func newStore(ctx context.Context, remote *remoteConfig) (*RcloneStorage, error) {
+	var err error
+
+	// only retention requires the S3 API, the other features fall back to
+	// what rclone provides without it
+	var s3 *s3Client
+	if remote.typee == "s3" {
+		s3, err = newS3Client(ctx, remote.base, remote.config)
+		if err != nil && remote.opts.retentionPeriod > 0 {
+			return nil, err
+		}
+	}
+
+	var retention *retention
+	if remote.opts.retentionPeriod > 0 {
+		if len(remote.overlays) != 0 {
+			return nil, fmt.Errorf("retention is not supported through the %s overlay", strings.Join(remote.overlays, " and "))
+		}
+		retention, err = newRetention(remote.typee, s3, remote.opts)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var cache *diskCache
+	if remote.opts.cacheDir != "" {
+		cache, err = newDiskCache(remote.opts.cacheDir, remote.opts.cacheMaxSize)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return &RcloneStorage{
-		Typee:    typee,
-		Base:     base,
-		confFile: file,
+		Typee: remote.typee,
+		Base:  remote.base,
 
-		location: location,
+		location: remote.location,
+		section:  remote.section,
+		root:     remote.root,
+		overlays: remote.overlays,
+		opts:     remote.opts,
+		mode:     remote.opts.mode,
+		cache:    cache,
+
+		tierSections: remote.tierSections,
+
+		transfers: newTransferLimit(remote.opts.transfers),
+
+		s3:        s3,
+		retention: retention,
 	}, nil
 }
 
-func (r *RcloneStorage) mkdir(pathname string) error {
-	payload := map[string]string{
-		"fs":     fmt.Sprintf("%s:%s", r.Typee, r.Base),
+func (r *RcloneStorage) mkdir(ctx context.Context, pathname string) error {
+	if err := r.checkWrite(pathname); err != nil {
+		return err
+	}
+
+	payload := map[string]any{
+		"fs":     r.remote(),
 		"remote": pathname,
 	}
 
-	jsonPayload, err := json.Marshal(payload)
+	_, err := r.opts.retry.RPC(ctx, "operations/mkdir", payload)
 	if err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	return nil
+}
+
+func (r *RcloneStorage) remote() string {
+	return fmt.Sprintf("%s:%s", r.section, r.root)
+}
+
+// remotePath returns the rclone remote rooted at dir within the repository.
+func (r *RcloneStorage) remotePath(dir string) string {
+	return fmt.Sprintf("%s:%s", r.section, path.Join(r.root, dir))
+}
+
+// fs returns the rclone backend for the store, shared with librclone's own
+// RPC calls through rclone's fs cache.
+func (r *RcloneStorage) fs(ctx context.Context) (fs.Fs, error) {
+	f, err := cache.Get(ctx, r.remote())
+	if err != nil {
+		return nil, fmt.Errorf("failed to open remote: %w", utils.TranslateError(r.remote(), err))
+	}
+	return f, nil
+}
+
+// putFile uploads rd to the remote object name. When the backend can rename
+// objects server-side, the data is first uploaded under a staging name and
+// only published once complete, so that an interrupted upload never leaves a
+// truncated object under a valid name.
+func (r *RcloneStorage) putFile(ctx context.Context, name string, rd io.Reader) (int64, error) {
+	if err := r.checkWrite(name); err != nil {
+		return 0, err
+	}
+
+	// the object and its staging name go through the remote of its tier
+	f, err := r.fsFor(ctx, name)
+	if err != nil {
+		return 0, err
+	}
+
+	if r.opts.skipExisting != skipExistingOff && isContentAddressed(name) {
+		skipped, size, replay, err := r.skipExisting(ctx, f, name, rd)
+		if err != nil {
+			return 0, err
+		}
+		if skipped {
+			return size, nil
+		}
+		if replay != nil {
+			defer replay.Close()
+			rd = replay
+		}
+	} else if err := r.checkOverwrite(ctx, f, name); err != nil {
+		return 0, err
+	}
+
+	var size int64
+	if !r.canStage(f) {
+		size, err = r.retryUpload(ctx, f, name, rd)
+		if err != nil {
+			return 0, err
+		}
+	} else {
+		// the staging object is removed even when ctx was cancelled
+		staging := stagingPath(name)
+		size, err = r.retryUpload(ctx, f, staging, rd)
+		if err != nil {
+			r.deleteFile(context.WithoutCancel(ctx), staging)
+			return 0, err
+		}
+
+		if err := r.moveFile(ctx, staging, name); err != nil {
+			r.deleteFile(context.WithoutCancel(ctx), staging)
+			return 0, err
+		}
+	}
+
+	return size, nil
+}
+
+// retryUpload runs upload under the retry policy, replaying rd on each
+// attempt. Uploads that can't seek and outgrow the retry buffer are not
+// retried, unless spooling them is allowed, and kloset retries them.
+func (r *RcloneStorage) retryUpload(ctx context.Context, f fs.Fs, name string, rd io.Reader) (int64, error) {
+	if r.opts.retry.MaxAttempts == 1 {
+		return r.upload(ctx, f, name, rd)
+	}
+
+	// the replay of skipExisting is already rewindable
+	rewinder, ok := rd.(*utils.Rewinder)
+	if !ok {
+		rewinder = utils.NewRewinder(rd, r.opts.retry.BufferSize, r.opts.retry.Spool)
+		defer rewinder.Close()
+	}
+
+	var size int64
+	err := r.opts.retry.Do(ctx, "upload "+r.remotePath(name), func() error {
+		if err := rewinder.Rewind(); err != nil {
+			return err
+		}
+		var err error
+		size, err = r.upload(ctx, f, name, rewinder)
+		if err != nil && !rewinder.CanRewind() {
+			return fserrors.NoRetryError(err)
+		}
 		return err
+	})
+	return size, err
+}
+
+// upload streams rd to the remote object name and checks that the object
+// has the expected size and hash once uploaded. Backends that cannot take an
+// upload of unknown size go through putFileSpooled instead.
+func (r *RcloneStorage) upload(ctx context.Context, f fs.Fs, name string, rd io.Reader) (int64, error) {
+	hasher, err := r.uploadHasher(f)
+	if err != nil {
+		return 0, err
+	}
+	if hasher != nil {
+		rd = io.TeeReader(rd, hasher)
 	}
 
-	body, resp := librclone.RPC("operations/mkdir", string(jsonPayload))
-	if resp != http.StatusOK {
-		return fmt.Errorf("failed to create directory: %s", body)
+	var size int64
+	if f.Features().PutStream == nil {
+		n, err := r.putFileSpooled(ctx, f, name, rd)
+		if err != nil {
+			return 0, err
+		}
+		size = n
+	} else {
+		counter := readers.NewCountingReader(rd)
+		_, err := operations.Rcat(ctx, f, name, io.NopCloser(counter), time.Now(), nil)
+		if err != nil {
+			return 0, fmt.Errorf("failed to put file: %w", utils.TranslateError(r.remotePath(name), err))
+		}
+		size = int64(counter.BytesRead())
 	}
 
-	return nil
+	if err := r.verifyUpload(ctx, f, name, size, hasher); err != nil {
+		return 0, err
+	}
+
+	return size, nil
 }
 
-func (r *RcloneStorage) putFile(name string, rd io.Reader) (int64, error) {
+func (r *RcloneStorage) putFileSpooled(ctx context.Context, f fs.Fs, name string, rd io.Reader) (int64, error) {
 	tmpFile, err := os.CreateTemp("", "tempfile-*.tmp")
 	if err != nil {
 		return 0, err
@@ -88,22 +449,17 @@ func (r *RcloneStorage) putFile(name string, rd io.Reader) (int64, error) {
 		return 0, err
 	}
 
-	payload := map[string]string{
+	payload := map[string]any{
 		"srcFs":     "/",
 		"srcRemote": tmpFile.Name(),
-		"dstFs":     fmt.Sprintf("%s:%s", r.Typee, r.Base),
+		"dstFs":     fs.ConfigString(f),
 		"dstRemote": name,
 	}
 
-	jsonPayload, err := json.Marshal(payload)
+	// retried along with the whole upload by retryUpload
+	_, err = utils.RPC(ctx, "operations/copyfile", payload)
 	if err != nil {
-		return 0, err
-	}
-
-	body, resp := librclone.RPC("operations/copyfile", string(jsonPayload))
-
-	if resp != http.StatusOK {
-		return 0, fmt.Errorf("failed to put file: %s", body)
+		return 0, fmt.Errorf("failed to put file: %w", err)
 	}
 
 	finfo, err := tmpFile.Stat()
@@ -114,124 +470,303 @@ func (r *RcloneStorage) putFile(name string, rd io.Reader) (int64, error) {
 	return finfo.Size(), nil
 }
 
-func (r *RcloneStorage) getFile(pathname string) (io.ReadSeekCloser, error) {
+func (r *RcloneStorage) getFile(ctx context.Context, pathname string) (io.ReadSeekCloser, error) {
 	name, err := utils.CreateTempPath("plakar_temp_*")
 	if err != nil {
 		return nil, err
 	}
 
-	payload := map[string]string{
-		"srcFs":     fmt.Sprintf("%s:%s", r.Typee, r.Base),
+	payload := map[string]any{
+		"srcFs":     r.remote(),
 		"srcRemote": pathname,
 
 		"dstFs":     strings.TrimSuffix(name, "/"+path.Base(name)),
 		"dstRemote": path.Base(name),
 	}
+	if config := r.transferConfig(); config != nil {
+		payload["_config"] = config
+	}
 
-	jsonPayload, err := json.Marshal(payload)
+	_, err = r.opts.retry.RPC(ctx, "operations/copyfile", payload)
+	if err != nil {
+		// don't leave a partial download behind
+		os.Remove(name)
+		return nil, fmt.Errorf("failed to get file: %w", err)
+	}
+
+	tmpFile, err := os.Open(name)
 	if err != nil {
 		return nil, err
 	}
 
-	body, status := librclone.RPC("operations/copyfile", string(jsonPayload))
+	return &utils.AutoremoveTmpFile{File: tmpFile}, nil
+}
 
-	if status != http.StatusOK {
-		return nil, fmt.Errorf("failed to get file: %s", body)
+// deleteFile removes the remote object pathname. States and packfiles can't
+// be removed from an append-only store.
+func (r *RcloneStorage) deleteFile(ctx context.Context, pathname string) error {
+	check := r.checkWrite
+	if isContentAddressed(pathname) {
+		check = r.checkDelete
+	}
+	if err := check(pathname); err != nil {
+		return err
 	}
 
-	tmpFile, err := os.Open(name)
+	payload := map[string]any{
+		"fs":     r.remote(),
+		"remote": pathname,
+	}
+
+	_, err := r.opts.retry.RPC(ctx, "operations/deletefile", payload)
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("failed to delete file: %w", err)
 	}
 
-	return &utils.AutoremoveTmpFile{tmpFile}, nil
+	return nil
+}
+
+func (r *RcloneStorage) listFolder(ctx context.Context, pathname string) ([]Entry, error) {
+	return r.list(ctx, pathname, nil)
+}
+
+// listFiles returns every file below pathname, recursively.
+func (r *RcloneStorage) listFiles(ctx context.Context, pathname string) ([]Entry, error) {
+	return r.list(ctx, pathname, map[string]interface{}{
+		"recurse":   true,
+		"filesOnly": true,
+	})
 }
 
-func (r *RcloneStorage) deleteFile(pathname string) error {
-	payload := map[string]string{
-		"fs":     fmt.Sprintf("%s:%s", r.Typee, r.Base),
+func (r *RcloneStorage) list(ctx context.Context, pathname string, opt map[string]interface{}) ([]Entry, error) {
+	payload := map[string]any{
+		"fs":     r.remote(),
 		"remote": pathname,
 	}
+	if opt != nil {
+		payload["opt"] = opt
+	}
 
-	jsonPayload, err := json.Marshal(payload)
+	output, err := r.opts.retry.RPC(ctx, "operations/list", payload)
 	if err != nil {
-		return fmt.Errorf("failed to marshal payload: %w", err)
+		return nil, fmt.Errorf("failed to list directory: %w", err)
 	}
 
-	body, resp := librclone.RPC("operations/deletefile", string(jsonPayload))
-	if resp != http.StatusOK {
-		return fmt.Errorf("failed to delete file: %s", body)
+	var response Response
+	err = json.Unmarshal([]byte(output), &response)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse response: %w", err)
 	}
 
-	return nil
+	return response.List, nil
 }
 
-func (r *RcloneStorage) listFolder(pathname string) ([]string, error) {
-	payload := map[string]interface{}{
-		"fs":     fmt.Sprintf("%s:%s", r.Typee, r.Base),
-		"remote": pathname,
+// rmdirs removes the empty folders below pathname, leaving pathname itself.
+func (r *RcloneStorage) rmdirs(ctx context.Context, pathname string) error {
+	if err := r.checkWrite(pathname); err != nil {
+		return err
 	}
 
-	jsonPayload, err := json.Marshal(payload)
+	payload := map[string]any{
+		"fs":        r.remote(),
+		"remote":    pathname,
+		"leaveRoot": true,
+	}
+
+	_, err := r.opts.retry.RPC(ctx, "operations/rmdirs", payload)
 	if err != nil {
-		return nil, fmt.Errorf("failed to marshal payload: %w", err)
+		return fmt.Errorf("failed to remove empty directories: %w", err)
+	}
+
+	return nil
+}
+
+// moveFile renames src to dst on the remote, server-side when the backend
+// supports it.
+func (r *RcloneStorage) moveFile(ctx context.Context, src, dst string) error {
+	if err := r.checkWrite(dst); err != nil {
+		return err
 	}
 
-	output, status := librclone.RPC("operations/list", string(jsonPayload))
-	if status != http.StatusOK {
-		return nil, fmt.Errorf("failed to list directory: %s", output)
+	payload := map[string]any{
+		"srcFs":     r.remote(),
+		"srcRemote": src,
+		"dstFs":     r.remote(),
+		"dstRemote": dst,
 	}
 
-	var response Response
-	err = json.Unmarshal([]byte(output), &response)
+	_, err := r.opts.retry.RPC(ctx, "operations/movefile", payload)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse response: %w", err)
+		return fmt.Errorf("failed to move file: %w", err)
 	}
 
-	var files []string
-	for _, file := range response.List {
-		files = append(files, file.Path)
+	return nil
+}
+
+// exists reports whether the object name exists on the remote.
+func (r *RcloneStorage) exists(ctx context.Context, name string) (bool, error) {
+	f, err := r.fs(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = f.NewObject(ctx, name)
+	if errors.Is(err, fs.ErrorObjectNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("failed to stat file: %w", utils.TranslateError(r.remotePath(name), err))
 	}
-	return files, nil
+	return true, nil
 }
 
+// repositoryDirs are the folders every repository has.
+var repositoryDirs = []string{"states", "packfiles", "locks"}
+
+// ErrIncomplete is returned by Open when the repository was not fully
+// initialized.
+var ErrIncomplete = errors.New("repository incomplete")
+
+// Create initializes the repository. CONFIG is written last and marks the
+// repository as complete, so that running Create again after it was
+// interrupted completes the initialization.
 func (r *RcloneStorage) Create(ctx context.Context, config []byte) error {
-	if r.mkdir("") != nil {
+	if err := r.checkWrite(""); err != nil {
+		return err
+	}
+
+	if err := r.checkTiers(ctx); err != nil {
+		return err
+	}
+
+	if r.mkdir(ctx, "") != nil {
 		return fmt.Errorf("failed to create root directory")
 	}
-	entries, err := r.listFolder("")
+	root, err := r.rootEntries(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to list root folder: %w", err)
+		return err
 	}
-	for _, entry := range entries {
-		if entry == "CONFIG" || entry == "states" || entry == "packfiles" || entry == "locks" {
-			return fmt.Errorf("storage %s already exists at %s:%s", entry, r.Typee, r.Base)
+	for _, name := range []string{"CONFIG", migrationFile} {
+		if root[name] {
+			return fmt.Errorf("storage %s already exists at %s", name, r.remote())
+		}
+	}
+	if root[layoutFile] || root["states"] || root["packfiles"] || root["locks"] {
+		if err := r.rollbackCreate(ctx, root); err != nil {
+			return err
+		}
+	}
+
+	for _, dir := range repositoryDirs {
+		if err := r.mkdir(ctx, dir); err != nil {
+			return err
 		}
 	}
 
-	_, err = r.putFile("CONFIG", bytes.NewReader(config))
+	r.layout = r.opts.layout
+	if r.layout != layoutFlat {
+		_, err = r.putFile(ctx, layoutFile, strings.NewReader(r.layout))
+		if err != nil {
+			return fmt.Errorf("failed to create layout file: %w", err)
+		}
+	}
+
+	_, err = r.putFile(ctx, "CONFIG", bytes.NewReader(config))
 	if err != nil {
 		return fmt.Errorf("failed to create config file: %w", err)
 	}
 
-	err = r.mkdir("states")
+	return nil
+}
+
+// rootEntries returns the names found at the root of the repository.
+func (r *RcloneStorage) rootEntries(ctx context.Context) (map[string]bool, error) {
+	entries, err := r.listFolder(ctx, "")
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("failed to list root folder: %w", err)
+	}
+
+	root := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		root[entry.Path] = true
 	}
-	err = r.mkdir("packfiles")
+	return root, nil
+}
+
+// rollbackCreate removes what an interrupted Create left behind, so that it
+// can start over. It refuses to if objects were already stored.
+func (r *RcloneStorage) rollbackCreate(ctx context.Context, root map[string]bool) error {
+	for _, dir := range repositoryDirs {
+		if !root[dir] {
+			continue
+		}
+		files, err := r.listFiles(ctx, dir)
+		if err != nil {
+			return fmt.Errorf("failed to list folder %s: %w", dir, err)
+		}
+		if len(files) != 0 {
+			return fmt.Errorf("storage %s already holds objects at %s", dir, r.remote())
+		}
+	}
+
+	if root[layoutFile] {
+		if err := r.deleteFile(ctx, layoutFile); err != nil {
+			return err
+		}
+	}
+
+	fs.Logf(nil, "completing the interrupted creation of the repository at %s", r.remote())
+	return nil
+}
+
+// checkComplete fails with ErrIncomplete if a folder of the repository is
+// missing. Backends without directories only have the folders holding
+// objects and are not checked.
+func (r *RcloneStorage) checkComplete(ctx context.Context) error {
+	f, err := r.fs(ctx)
 	if err != nil {
 		return err
 	}
-	err = r.mkdir("locks")
+	if !f.Features().CanHaveEmptyDirectories {
+		return nil
+	}
+
+	root, err := r.rootEntries(ctx)
 	if err != nil {
 		return err
 	}
-
+	for _, dir := range repositoryDirs {
+		if !root[dir] {
+			return fmt.Errorf("%w at %s: folder %s is missing", ErrIncomplete, r.remote(), dir)
+		}
+	}
 	return nil
 }
 
 func (r *RcloneStorage) Open(ctx context.Context) ([]byte, error) {
-	rd, err := r.getFile("CONFIG")
+	if err := r.checkTiers(ctx); err != nil {
+		return nil, err
+	}
+
+	migrating, err := r.exists(ctx, migrationFile)
+	if err != nil {
+		return nil, err
+	}
+	if migrating {
+		return nil, fmt.Errorf("repository layout migration in progress at %s, run it again to complete it", r.remote())
+	}
+
+	layout, err := r.readLayout(ctx)
+	if err != nil {
+		return nil, err
+	}
+	r.layout = layout
+
+	rd, err := r.getFile(ctx, "CONFIG")
+	if errors.Is(err, iofs.ErrNotExist) {
+		if root, rerr := r.rootEntries(ctx); rerr == nil && (root[layoutFile] || root["states"] || root["packfiles"] || root["locks"]) {
+			return nil, fmt.Errorf("%w at %s: CONFIG is missing, its creation or transfer was interrupted and must be run again", ErrIncomplete, r.remote())
+		}
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to open config file: %w", err)
 	}
@@ -242,6 +777,16 @@ func (r *RcloneStorage) Open(ctx context.Context) ([]byte, error) {
 		return nil, fmt.Errorf("failed to read config file: %w", err)
 	}
 
+	if err := r.checkComplete(ctx); err != nil {
+		return nil, err
+	}
+
+	// only write to a remote known to hold a complete repository
+	r.probeWrite(ctx)
+	if r.mode != modeReadOnly {
+		r.cleanupStaging(ctx)
+	}
+
 	return configData, nil
 }
 
@@ -249,71 +794,194 @@ func (r *RcloneStorage) Location(ctx context.Context) (string, error) {
 	return r.location + "+" + r.Typee + "://" + r.Base, nil
 }
 
+// Mode reports whether the store can be written to. Append-only stores are
+// writable, the deletions they refuse fail when attempted.
 func (r *RcloneStorage) Mode(ctx context.Context) (storage.Mode, error) {
+	if r.mode == modeReadOnly {
+		return storage.ModeRead, nil
+	}
 	return storage.ModeRead | storage.ModeWrite, nil
 }
 
-func (r *RcloneStorage) Size(ctx context.Context) (int64, error) {
-	return -1, nil //TODO: Implement size calculation
+type Entry struct {
+	Path     string `json:"Path"`
+	Name     string `json:"Name"`
+	Size     int64  `json:"Size"`
+	MimeType string `json:"MimeType"`
+	ModTime  string `json:"ModTime"`
+	IsDir    bool   `json:"isDir"`
+	ID       string `json:"ID"`
 }
 
 type Response struct {
-	List []struct {
-		Path     string `json:"Path"`
-		Name     string `json:"Name"`
-		Size     int64  `json:"Size"`
-		MimeType string `json:"MimeType"`
-		ModTime  string `json:"ModTime"`
-		IsDir    bool   `json:"isDir"`
-		ID       string `json:"ID"`
-	} `json:"list"`
+	List []Entry `json:"list"`
 }
 
-func (r *RcloneStorage) getMacs(name string) ([]objects.MAC, error) {
-	entries, err := r.listFolder(name)
+func (r *RcloneStorage) getMacs(ctx context.Context, name string) ([]objects.MAC, error) {
+	var entries []Entry
+	var err error
+	if r.isSharded(name) {
+		entries, err = r.listShards(ctx, name)
+	} else {
+		entries, err = r.listFolder(ctx, name)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to list folder %s: %w", name, err)
 	}
 
+	macs, foreign := entriesToMacs(entries)
+	if r.opts.reconcileDuplicates {
+		macs, foreign = r.reconcileDuplicates(ctx, macs, foreign)
+	}
+	r.setForeign(name, foreign)
+
+	return macs, nil
+}
+
+// entriesToMacs returns the MACs named by entries, and the entries that
+// don't name one.
+func entriesToMacs(entries []Entry) ([]objects.MAC, []Entry) {
 	var macs []objects.MAC
+	var foreign []Entry
 	for _, file := range entries {
-		mac, err := hex.DecodeString(path.Base(file))
-		if err != nil {
-			return nil, fmt.Errorf("failed to create MAC from ID %s: %w", file, err)
+		mac, err := hex.DecodeString(path.Base(file.Path))
+		if file.IsDir || err != nil || len(mac) != len(objects.MAC{}) {
+			fs.Logf(nil, "skipping %s: not a MAC", file.Path)
+			foreign = append(foreign, file)
+			continue
 		}
 
 		macs = append(macs, objects.MAC(mac))
 	}
 
-	return macs, nil
+	return macs, foreign
 }
 
 func (r *RcloneStorage) GetStates(ctx context.Context) ([]objects.MAC, error) {
-	return r.getMacs("states")
+	return r.getMacs(ctx, "states")
 }
 
 func (r *RcloneStorage) PutState(ctx context.Context, mac objects.MAC, rd io.Reader) (int64, error) {
-	return r.putFile(fmt.Sprintf("states/%064x", mac), rd)
+	return r.putRetained(ctx, r.objectPath("states", mac), rd)
 }
 
 func (r *RcloneStorage) GetState(ctx context.Context, mac objects.MAC) (io.ReadCloser, error) {
-	return r.getFile(fmt.Sprintf("states/%064x", mac))
+	return r.getObject(ctx, "states", mac)
 }
 
 func (r *RcloneStorage) DeleteState(ctx context.Context, mac objects.MAC) error {
-	return r.deleteFile(fmt.Sprintf("states/%064x", mac))
+	if err := r.checkDelete(r.objectPath("states", mac)); err != nil {
+		return err
+	}
+	if r.cache != nil {
+		r.cache.removePrefix(cacheKey("states", mac))
+	}
+	return r.deleteRetained(ctx, r.objectPath("states", mac))
 }
 
 func (r *RcloneStorage) GetPackfiles(ctx context.Context) ([]objects.MAC, error) {
-	return r.getMacs("packfiles")
+	return r.getMacs(ctx, "packfiles")
 }
 
 func (r *RcloneStorage) PutPackfile(ctx context.Context, mac objects.MAC, rd io.Reader) (int64, error) {
-	return r.putFile(fmt.Sprintf("packfiles/%064x", mac), rd)
+	return r.putRetained(ctx, r.objectPath("packfiles", mac), rd)
+}
+
+// putRetained uploads the object name and places it under retention when
+// configured.
+func (r *RcloneStorage) putRetained(ctx context.Context, name string, rd io.Reader) (int64, error) {
+	done, err := r.acquireTransfer(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+
+	return r.putObject(ctx, name, rd)
+}
+
+// putObject is putRetained for callers already holding a transfer slot.
+func (r *RcloneStorage) putObject(ctx context.Context, name string, rd io.Reader) (int64, error) {
+	size, err := r.putFile(ctx, name, rd)
+	if err != nil {
+		return 0, err
+	}
+
+	if r.retention != nil {
+		if err := r.retention.apply(ctx, name); err != nil {
+			return 0, err
+		}
+	}
+
+	return size, nil
+}
+
+// deleteRetained deletes the object name unless it is under retention.
+func (r *RcloneStorage) deleteRetained(ctx context.Context, name string) error {
+	if r.retention != nil {
+		if err := r.retention.check(ctx, name); err != nil {
+			return err
+		}
+	}
+
+	return r.deleteFile(ctx, name)
 }
 
 func (r *RcloneStorage) GetPackfile(ctx context.Context, mac objects.MAC) (io.ReadCloser, error) {
-	return r.getFile(fmt.Sprintf("packfiles/%064x", mac))
+	return r.getObject(ctx, "packfiles", mac)
+}
+
+// getObject downloads the object mac of dir, going through the local cache
+// when one is configured.
+func (r *RcloneStorage) getObject(ctx context.Context, dir string, mac objects.MAC) (io.ReadCloser, error) {
+	name := r.objectPath(dir, mac)
+
+	var key string
+	if r.cache != nil {
+		key = cacheKey(dir, mac)
+		if fp, found := r.cache.get(key); found {
+			return fp, nil
+		}
+	}
+
+	rd, err := r.downloadFile(ctx, name)
+	if err != nil {
+		// the transfer slot is not held while waiting for a restore
+		if err := r.restoreArchived(ctx, name, err); err != nil {
+			return nil, err
+		}
+		rd, err = r.downloadFile(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if r.cache == nil {
+		return rd, nil
+	}
+
+	fp, err := r.cache.put(key, rd)
+	if err != nil {
+		// the object could not be cached, serve it from the download
+		if _, err := rd.Seek(0, io.SeekStart); err != nil {
+			rd.Close()
+			return nil, err
+		}
+		return rd, nil
+	}
+	rd.Close()
+
+	return fp, nil
+}
+
+// downloadFile is getFile counted as a transfer.
+func (r *RcloneStorage) downloadFile(ctx context.Context, name string) (io.ReadSeekCloser, error) {
+	done, err := r.acquireTransfer(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	return r.getFile(ctx, name)
 }
 
 func limitReadCloser(r io.ReadCloser, n int64) io.ReadCloser {
@@ -325,42 +993,165 @@ type limitedReadCloser struct {
 	io.Closer
 }
 
+// getFileRange opens length bytes at offset of the remote object pathname
+// without downloading the rest of it.
+func (r *RcloneStorage) getFileRange(ctx context.Context, pathname string, offset, length int64) (io.ReadCloser, error) {
+	if length == 0 {
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+
+	f, err := r.fs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var rd io.ReadCloser
+	err = r.opts.retry.Do(ctx, "read "+r.remotePath(pathname), func() error {
+		obj, err := f.NewObject(ctx, pathname)
+		if err != nil {
+			return fmt.Errorf("failed to get file: %w", utils.TranslateError(r.remotePath(pathname), err))
+		}
+
+		rd, err = obj.Open(ctx, &fs.RangeOption{Start: offset, End: offset + length - 1})
+		if err != nil {
+			return fmt.Errorf("failed to open range: %w", utils.TranslateError(r.remotePath(pathname), err))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return readers.NewLimitedReadCloser(rd, length), nil
+}
+
 func (r *RcloneStorage) GetPackfileBlob(ctx context.Context, mac objects.MAC, offset uint64, length uint32) (io.ReadCloser, error) {
-	rd, err := r.getFile(fmt.Sprintf("packfiles/%064x", mac))
+	if r.cache == nil || int64(length) > r.cache.maxSize {
+		return r.getPackfileBlob(ctx, mac, offset, length)
+	}
+
+	if fp, found := r.cache.get(cacheKey("packfiles", mac)); found {
+		if _, err := fp.Seek(int64(offset), io.SeekStart); err != nil {
+			fp.Close()
+			return nil, err
+		}
+		return limitReadCloser(fp, int64(length)), nil
+	}
+
+	key := blobCacheKey(mac, offset, length)
+	if fp, found := r.cache.get(key); found {
+		return fp, nil
+	}
+
+	rd, err := r.getPackfileBlob(ctx, mac, offset, length)
 	if err != nil {
 		return nil, err
 	}
+	fp, err := r.cache.put(key, rd)
+	rd.Close()
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		// the blob could not be cached, fetch it again and serve it as is
+		return r.getPackfileBlob(ctx, mac, offset, length)
+	}
 
-	_, err = rd.Seek(int64(offset), io.SeekStart)
+	return fp, nil
+}
+
+func (r *RcloneStorage) getPackfileBlob(ctx context.Context, mac objects.MAC, offset uint64, length uint32) (io.ReadCloser, error) {
+	pathname := r.objectPath("packfiles", mac)
+
+	rd, err := r.downloadRange(ctx, pathname, offset, length)
+	if err == nil {
+		return rd, nil
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	// the transfer slot is not held while waiting for a restore
+	if err := r.restoreArchived(ctx, pathname, err); err != nil {
+		return nil, err
+	}
+	return r.downloadRange(ctx, pathname, offset, length)
+}
+
+// downloadRange reads length bytes at offset of the object name, counted as
+// a transfer, and falls back to a full download when the backend can't serve
+// the range.
+func (r *RcloneStorage) downloadRange(ctx context.Context, name string, offset uint64, length uint32) (io.ReadCloser, error) {
+	done, err := r.acquireTransfer(ctx)
 	if err != nil {
 		return nil, err
 	}
+	defer done()
 
-	return limitReadCloser(rd, int64(length)), nil
+	rd, err := r.getFileRange(ctx, name, int64(offset), int64(length))
+	if err == nil || !rangeUnsupported(ctx, err) {
+		return rd, err
+	}
+	return r.getFileBlob(ctx, name, offset, length)
 }
 
-func (r *RcloneStorage) DeletePackfile(ctx context.Context, mac objects.MAC) error {
-	return r.deleteFile(fmt.Sprintf("packfiles/%064x", mac))
+// rangeUnsupported reports whether the ranged read that failed with err may
+// succeed as a full download. Missing objects, denied access and the
+// failures the retry policy already went through would fail it as well.
+func rangeUnsupported(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	for _, kind := range []error{
+		context.Canceled, context.DeadlineExceeded,
+		iofs.ErrNotExist, iofs.ErrPermission,
+		utils.ErrRetryable, utils.ErrRateLimited, utils.ErrQuotaExceeded,
+	} {
+		if errors.Is(err, kind) {
+			return false
+		}
+	}
+	return true
 }
 
-func (r *RcloneStorage) GetLocks(ctx context.Context) ([]objects.MAC, error) {
-	return r.getMacs("locks")
+func (r *RcloneStorage) getFileBlob(ctx context.Context, pathname string, offset uint64, length uint32) (io.ReadCloser, error) {
+	rd, err := r.getFile(ctx, pathname)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = rd.Seek(int64(offset), io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	return limitReadCloser(rd, int64(length)), nil
 }
 
-func (r *RcloneStorage) PutLock(ctx context.Context, lockID objects.MAC, rd io.Reader) (int64, error) {
-	return r.putFile(fmt.Sprintf("locks/%064x", lockID), rd)
+func (r *RcloneStorage) DeletePackfile(ctx context.Context, mac objects.MAC) error {
+	if err := r.checkDelete(r.objectPath("packfiles", mac)); err != nil {
+		return err
+	}
+	if r.cache != nil {
+		r.cache.removePrefix(cacheKey("packfiles", mac))
+	}
+	return r.deleteRetained(ctx, r.objectPath("packfiles", mac))
 }
 
 func (r *RcloneStorage) GetLock(ctx context.Context, lockID objects.MAC) (io.ReadCloser, error) {
-	return r.getFile(fmt.Sprintf("locks/%064x", lockID))
+	return r.getFile(ctx, r.objectPath("locks", lockID))
 }
 
 func (r *RcloneStorage) DeleteLock(ctx context.Context, lockID objects.MAC) error {
-	return r.deleteFile(fmt.Sprintf("locks/%064x", lockID))
+	name := r.objectPath("locks", lockID)
+	r.forgetLock(name)
+	return r.deleteFile(ctx, name)
 }
 
 func (r *RcloneStorage) Close(ctx context.Context) error {
-	utils.DeleteTempConf(r.confFile.Name())
+	if r.confFile != nil {
+		utils.DeleteTempConf(r.confFile.Name())
+	}
 	librclone.Finalize()
 	return nil
 }
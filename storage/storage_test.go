@@ -0,0 +1,239 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	iofs "io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+// newLocalStore returns a store on the local directory dir, with the store
+// options in config.
+func newLocalStore(t *testing.T, dir string, config map[string]string) *RcloneStorage {
+	t.Helper()
+
+	cfg := map[string]string{
+		"location": "rclone://" + dir,
+		"type":     "local",
+	}
+	for key, value := range config {
+		cfg[key] = value
+	}
+
+	store, err := NewRcloneStorage(context.Background(), "test", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store.(*RcloneStorage)
+}
+
+// newLocalRepository returns a store on a repository created in a temporary
+// directory, closed at the end of the test.
+func newLocalRepository(t *testing.T, config map[string]string) (*RcloneStorage, string) {
+	t.Helper()
+	ctx := context.Background()
+
+	dir := filepath.Join(t.TempDir(), "repo")
+	store := newLocalStore(t, dir, config)
+	t.Cleanup(func() { store.Close(ctx) })
+
+	if err := store.Create(ctx, []byte("config")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Open(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return store, dir
+}
+
+func TestPutFile(t *testing.T) {
+	ctx := context.Background()
+	store, dir := newLocalRepository(t, nil)
+
+	var mac objects.MAC
+	mac[0] = 1
+	data := strings.Repeat("data", 1000)
+
+	// the reader hides its Seek method, as kloset's do
+	n, err := store.PutPackfile(ctx, mac, struct{ io.Reader }{strings.NewReader(data)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(data)) {
+		t.Errorf("put %d bytes, expected %d", n, len(data))
+	}
+
+	content, err := os.ReadFile(filepath.Join(dir, store.objectPath("packfiles", mac)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != data {
+		t.Error("stored content differs from the data put")
+	}
+
+	rd, err := store.GetPackfile(ctx, mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rd.Close()
+	content, err = io.ReadAll(rd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != data {
+		t.Error("read content differs from the data put")
+	}
+
+	// the upload went through a staging name, which is gone
+	staged, err := os.ReadDir(filepath.Join(dir, stagingDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(staged) != 0 {
+		t.Errorf("%d staging objects left behind", len(staged))
+	}
+}
+
+func TestPutFileFailedRead(t *testing.T) {
+	ctx := context.Background()
+	store, dir := newLocalRepository(t, map[string]string{"retry_attempts": "1"})
+
+	var mac objects.MAC
+	mac[0] = 1
+	rd := io.MultiReader(strings.NewReader("partial"), iotest.ErrReader(errors.New("read failed")))
+	if _, err := store.PutPackfile(ctx, mac, rd); err == nil {
+		t.Fatal("put succeeded with a failing reader")
+	}
+
+	// neither a truncated object nor its staging object are left
+	if _, err := os.Stat(filepath.Join(dir, store.objectPath("packfiles", mac))); !os.IsNotExist(err) {
+		t.Error("truncated object published")
+	}
+	staged, _ := os.ReadDir(filepath.Join(dir, stagingDir))
+	if len(staged) != 0 {
+		t.Errorf("%d staging objects left behind", len(staged))
+	}
+}
+
+func TestCleanupStaging(t *testing.T) {
+	ctx := context.Background()
+	store, dir := newLocalRepository(t, map[string]string{"staging_max_age": "1h"})
+
+	stale := filepath.Join(dir, stagingPath("packfiles/stale"))
+	fresh := filepath.Join(dir, stagingPath("packfiles/fresh"))
+	for _, name := range []string{stale, fresh} {
+		if err := os.WriteFile(name, []byte("partial"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(stale, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	store.cleanupStaging(ctx)
+
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Error("stale staging object kept")
+	}
+	if _, err := os.Stat(fresh); err != nil {
+		t.Error("staging object of an upload in progress removed")
+	}
+}
+
+func TestGetPackfileBlob(t *testing.T) {
+	ctx := context.Background()
+	store, _ := newLocalRepository(t, nil)
+
+	var mac objects.MAC
+	mac[0] = 1
+	data := "0123456789abcdefghij"
+	if _, err := store.PutPackfile(ctx, mac, strings.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		offset uint64
+		length uint32
+	}{
+		{0, 4},
+		{5, 10},
+		{16, 4},
+		{19, 1},
+		{0, uint32(len(data))},
+		{7, 0},
+		{uint64(len(data)), 0},
+	} {
+		rd, err := store.GetPackfileBlob(ctx, mac, test.offset, test.length)
+		if err != nil {
+			t.Errorf("blob %d+%d: %v", test.offset, test.length, err)
+			continue
+		}
+		blob, err := io.ReadAll(rd)
+		rd.Close()
+		if err != nil {
+			t.Errorf("blob %d+%d: %v", test.offset, test.length, err)
+			continue
+		}
+		expected := data[test.offset : test.offset+uint64(test.length)]
+		if string(blob) != expected {
+			t.Errorf("blob %d+%d is %q, expected %q", test.offset, test.length, blob, expected)
+		}
+	}
+}
+
+func TestGetPackfileBlobMissing(t *testing.T) {
+	ctx := context.Background()
+	store, _ := newLocalRepository(t, nil)
+
+	var mac objects.MAC
+	mac[0] = 1
+	if _, err := store.GetPackfileBlob(ctx, mac, 0, 4); !errors.Is(err, iofs.ErrNotExist) {
+		t.Errorf("reading a missing packfile returned %v, expected ErrNotExist", err)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := store.GetPackfileBlob(cancelled, mac, 0, 4); !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled read returned %v, expected context.Canceled", err)
+	}
+}
+
+func TestGetPackfileBlobCacheFailure(t *testing.T) {
+	ctx := context.Background()
+	cacheDir := filepath.Join(t.TempDir(), "cache")
+	store, _ := newLocalRepository(t, map[string]string{"cache_dir": cacheDir})
+
+	var mac objects.MAC
+	mac[0] = 1
+	data := "0123456789abcdefghij"
+	if _, err := store.PutPackfile(ctx, mac, strings.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the blob can't be written to the cache anymore
+	if err := os.RemoveAll(cacheDir); err != nil {
+		t.Fatal(err)
+	}
+
+	rd, err := store.GetPackfileBlob(ctx, mac, 5, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rd.Close()
+	blob, err := io.ReadAll(rd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(blob) != data[5:15] {
+		t.Errorf("blob is %q, expected %q", blob, data[5:15])
+	}
+}
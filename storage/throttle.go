@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/rclone/rclone/fs"
+	"golang.org/x/sync/semaphore"
+)
+
+// backendOptions maps the store options tuning uploads to the backend
+// options they set, on the backends that have them.
+var backendOptions = map[string]string{
+	"upload_chunk_size":  "chunk_size",
+	"upload_concurrency": "upload_concurrency",
+}
+
+// setBackendOptions copies the upload options of opts to the configuration
+// of the backend typee. Options the backend doesn't have are ignored.
+func setBackendOptions(typee string, config map[string]string, opts *options) error {
+	values := map[string]string{}
+	if opts.uploadChunkSize > 0 {
+		values["upload_chunk_size"] = fs.SizeSuffix(opts.uploadChunkSize).String()
+	}
+	if opts.uploadConcurrency > 0 {
+		values["upload_concurrency"] = strconv.Itoa(opts.uploadConcurrency)
+	}
+	if len(values) == 0 {
+		return nil
+	}
+
+	info, err := fs.Find(typee)
+	if err != nil {
+		return fmt.Errorf("failed to find backend %s: %w", typee, err)
+	}
+
+	for option, value := range values {
+		name := backendOptions[option]
+		if !hasOption(info, name) {
+			fs.Logf(nil, "ignoring %s: the %s backend has no %s option", option, typee, name)
+			continue
+		}
+		config[name] = value
+	}
+	return nil
+}
+
+func hasOption(info *fs.RegInfo, name string) bool {
+	for _, option := range info.Options {
+		if option.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// newTransferLimit returns the semaphore bounding the concurrent transfers
+// of a store, nil if they are not bounded.
+func newTransferLimit(transfers int) *semaphore.Weighted {
+	if transfers <= 0 {
+		return nil
+	}
+	return semaphore.NewWeighted(int64(transfers))
+}
+
+// acquireTransfer waits until the store runs less than transfers state and
+// packfile transfers, and returns the function ending the transfer. Ranged
+// reads end once their stream is opened. Locks and the files at the root
+// don't go through it, so that lock renewals are not held up by large
+// uploads.
+func (r *RcloneStorage) acquireTransfer(ctx context.Context) (func(), error) {
+	if r.transfers == nil {
+		return func() {}, nil
+	}
+	if err := r.transfers.Acquire(ctx, 1); err != nil {
+		return nil, err
+	}
+	return func() { r.transfers.Release(1) }, nil
+}
+
+// transferConfig returns the rclone options overriding the global ones for
+// the librclone transfers of the store, nil if there are none.
+func (r *RcloneStorage) transferConfig() map[string]any {
+	config := map[string]any{}
+	if r.opts.multiThreadStreams >= 0 {
+		config["MultiThreadStreams"] = r.opts.multiThreadStreams
+		config["MultiThreadSet"] = true
+	}
+	if r.opts.multiThreadCutoff > 0 {
+		config["MultiThreadCutoff"] = r.opts.multiThreadCutoff
+	}
+	if len(config) == 0 {
+		return nil
+	}
+	return config
+}
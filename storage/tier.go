@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"strings"
+
+	"github.com/PlakarKorp/integration-rclone/utils"
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/cache"
+)
+
+// ErrArchived is returned when reading an object that sits in an archive
+// tier and must be restored before it can be read.
+var ErrArchived = errors.New("object is archived")
+
+// tierPrefixes are the repository prefixes that can be given their own
+// storage class, "config" covering the files at the root.
+var tierPrefixes = []string{"config", "states", "packfiles", "locks"}
+
+// tierOptions lists the backend options setting the storage class or tier
+// objects are uploaded to, by order of preference.
+var tierOptions = []string{"storage_class", "access_tier"}
+
+// isArchiveTier reports whether objects in tier of the backend typee can't
+// be read without being restored first. GCS Archive objects are read
+// directly.
+func isArchiveTier(typee, tier string) bool {
+	switch strings.ToUpper(tier) {
+	case "GLACIER", "DEEP_ARCHIVE":
+		return typee == "s3"
+	case "ARCHIVE":
+		return typee == "azureblob"
+	}
+	return false
+}
+
+func tierPrefix(name string) string {
+	prefix, _, found := strings.Cut(name, "/")
+	if !found {
+		return "config"
+	}
+	return prefix
+}
+
+// checkTiers fails if storage tiers are configured on a remote that doesn't
+// support them.
+func (r *RcloneStorage) checkTiers(ctx context.Context) error {
+	if len(r.opts.tiers) == 0 {
+		return nil
+	}
+
+	f, err := r.fs(ctx)
+	if err != nil {
+		return err
+	}
+	if !f.Features().SetTier {
+		return fmt.Errorf("remote %s does not support storage tiers", r.remote())
+	}
+	return nil
+}
+
+// addTierSections adds, for each prefix given a tier, a copy of the
+// section of remote uploading its objects to that tier, so that they are
+// written in their storage class instead of being moved to it afterwards.
+func (remote *remoteConfig) addTierSections() error {
+	if len(remote.opts.tiers) == 0 {
+		return nil
+	}
+
+	info, err := fs.Find(remote.typee)
+	if err != nil {
+		return fmt.Errorf("failed to find backend %s: %w", remote.typee, err)
+	}
+	var option string
+	for _, name := range tierOptions {
+		if hasOption(info, name) {
+			option = name
+			break
+		}
+	}
+	if option == "" {
+		return fmt.Errorf("the %s backend does not support storage tiers", remote.typee)
+	}
+
+	for prefix, tier := range remote.opts.tiers {
+		name := remote.section + "_tier_" + prefix
+		if _, found := remote.sections[name]; found {
+			return fmt.Errorf("section %s is reserved for the tier of %s", name, prefix)
+		}
+
+		config := maps.Clone(remote.config)
+		config[option] = tier
+		remote.sections[name] = config
+		remote.tierSections[prefix] = name
+	}
+	return nil
+}
+
+// remoteFor returns the rclone remote the object name is uploaded through,
+// the one of its tier if it has one.
+func (r *RcloneStorage) remoteFor(name string) string {
+	if section, found := r.tierSections[tierPrefix(name)]; found {
+		return fmt.Sprintf("%s:%s", section, r.root)
+	}
+	return r.remote()
+}
+
+// fsFor returns the rclone backend the object name is uploaded through.
+func (r *RcloneStorage) fsFor(ctx context.Context, name string) (fs.Fs, error) {
+	remote := r.remoteFor(name)
+	f, err := cache.Get(ctx, remote)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open remote: %w", utils.TranslateError(remote, err))
+	}
+	return f, nil
+}
+
+// archiveTier returns the tier of the object name if it is an archive tier.
+func (r *RcloneStorage) archiveTier(ctx context.Context, name string) (string, bool) {
+	f, err := r.fs(ctx)
+	if err != nil || !f.Features().GetTier {
+		return "", false
+	}
+
+	obj, err := f.NewObject(ctx, name)
+	if err != nil {
+		return "", false
+	}
+
+	getter, ok := obj.(fs.GetTierer)
+	if !ok || !isArchiveTier(r.Typee, getter.GetTier()) {
+		return "", false
+	}
+	return getter.GetTier(), true
+}
@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"testing"
+)
+
+func TestIsArchiveTier(t *testing.T) {
+	for _, test := range []struct {
+		typee, tier string
+		expected    bool
+	}{
+		{"s3", "GLACIER", true},
+		{"s3", "deep_archive", true},
+		{"s3", "STANDARD_IA", false},
+		{"s3", "GLACIER_IR", false},
+		{"azureblob", "Archive", true},
+		{"azureblob", "Cool", false},
+		{"google cloud storage", "ARCHIVE", false},
+		{"google cloud storage", "COLDLINE", false},
+	} {
+		if got := isArchiveTier(test.typee, test.tier); got != test.expected {
+			t.Errorf("isArchiveTier(%q, %q) = %v, expected %v", test.typee, test.tier, got, test.expected)
+		}
+	}
+}
+
+func TestTierPrefix(t *testing.T) {
+	for name, expected := range map[string]string{
+		"CONFIG":            "config",
+		"LAYOUT":            "config",
+		"packfiles/ab":      "packfiles",
+		"states/ab/abcdef":  "states",
+		"locks/0123456789a": "locks",
+	} {
+		if got := tierPrefix(name); got != expected {
+			t.Errorf("tierPrefix(%q) = %q, expected %q", name, got, expected)
+		}
+	}
+}
+
+func TestTierSections(t *testing.T) {
+	remote, err := parseRemote("test", "", map[string]string{
+		"location":       "rclone://bucket/repo",
+		"type":           "s3",
+		"tier_packfiles": "DEEP_ARCHIVE",
+		"crypt_password": "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	section, found := remote.tierSections["packfiles"]
+	if !found || len(remote.tierSections) != 1 {
+		t.Fatalf("tier sections are %v, expected one for packfiles", remote.tierSections)
+	}
+	if section != "s3_tier_packfiles_crypt" {
+		t.Errorf("packfiles go through %s, expected the crypt overlay of their tier", section)
+	}
+	if remote.sections[section]["remote"] != "s3_tier_packfiles:bucket/repo" {
+		t.Errorf("tier overlay wraps %q", remote.sections[section]["remote"])
+	}
+	if remote.sections["s3_tier_packfiles"]["storage_class"] != "DEEP_ARCHIVE" {
+		t.Errorf("tier section %v doesn't set the storage class", remote.sections["s3_tier_packfiles"])
+	}
+	if _, found := remote.sections["s3"]["storage_class"]; found {
+		t.Error("storage class set on the section of the store")
+	}
+
+	store := &RcloneStorage{section: remote.section, root: remote.root, tierSections: remote.tierSections}
+	if got := store.remoteFor("packfiles/ab"); got != "s3_tier_packfiles_crypt:" {
+		t.Errorf("packfiles uploaded through %s", got)
+	}
+	if got := store.remoteFor("states/ab"); got != "s3_crypt:" {
+		t.Errorf("states uploaded through %s", got)
+	}
+}
+
+func TestTierUnsupported(t *testing.T) {
+	_, err := parseRemote("test", "", map[string]string{
+		"location":       "rclone:///tmp/repo",
+		"type":           "local",
+		"tier_packfiles": "ARCHIVE",
+	})
+	if err == nil {
+		t.Fatal("tier accepted on a backend without storage classes")
+	}
+}
@@ -0,0 +1,370 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/PlakarKorp/kloset/objects"
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/hash"
+	"github.com/rclone/rclone/fs/walk"
+	"golang.org/x/sync/errgroup"
+)
+
+// Transfer copies a repository from one rclone remote to another without
+// going through the local disk.
+type Transfer struct {
+	src *RcloneStorage
+	dst *RcloneStorage
+}
+
+// TransferReport is the result of Transfer.Run.
+type TransferReport struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+
+	// Copied and Present count, by folder, the objects copied by this run
+	// and the ones already on the destination.
+	Copied  map[string]int `json:"copied"`
+	Present map[string]int `json:"present"`
+
+	// Mismatches lists the objects that failed the final verification.
+	// They are removed from the destination so that the next run copies
+	// them again.
+	Mismatches []string `json:"mismatches"`
+}
+
+// NewTransfer builds a transfer between the stores described by the src and
+// dst configurations.
+func NewTransfer(ctx context.Context, src, dst map[string]string) (*Transfer, error) {
+	srcRemote, err := parseRemote("source", "src", src)
+	if err != nil {
+		return nil, err
+	}
+	dstRemote, err := parseRemote("destination", "dst", dst)
+	if err != nil {
+		return nil, err
+	}
+
+	// the source is only read, opening it must not probe it for writes or
+	// remove its staging objects
+	srcRemote.opts.mode = modeReadOnly
+
+	stores, err := newStores(ctx, []*remoteConfig{srcRemote, dstRemote})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Transfer{src: stores[0], dst: stores[1]}, nil
+}
+
+// Run copies CONFIG, the states and packfiles that are missing on the
+// destination, at most concurrency at a time, then verifies the size and
+// hash of every object. Locks belong to the hosts using the source and are
+// not copied. CONFIG is copied last, so that the destination can't
+// be opened before the transfer is complete, and an interrupted transfer is
+// resumed by running it again.
+func (t *Transfer) Run(ctx context.Context, concurrency int) (*TransferReport, error) {
+	report := &TransferReport{
+		Source:      t.src.remote(),
+		Destination: t.dst.remote(),
+		Copied:      make(map[string]int),
+		Present:     make(map[string]int),
+		Mismatches:  []string{},
+	}
+
+	if err := t.dst.checkWrite(""); err != nil {
+		return nil, err
+	}
+
+	config, err := t.src.Open(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	hasConfig, err := t.dst.exists(ctx, "CONFIG")
+	if err != nil {
+		return nil, err
+	}
+	if hasConfig {
+		if err := t.checkConfig(ctx, config); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := t.prepare(ctx); err != nil {
+		return nil, err
+	}
+
+	for _, dir := range []string{"states", "packfiles"} {
+		if err := t.copyFolder(ctx, dir, concurrency, report); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, dir := range []string{"states", "packfiles"} {
+		mismatches, err := t.verifyFolder(ctx, dir)
+		if err != nil {
+			return nil, err
+		}
+		report.Mismatches = append(report.Mismatches, mismatches...)
+	}
+
+	if len(report.Mismatches) != 0 {
+		return report, nil
+	}
+
+	if hasConfig {
+		report.Present["config"]++
+	} else {
+		if _, err := t.dst.putFile(ctx, "CONFIG", bytes.NewReader(config)); err != nil {
+			return nil, fmt.Errorf("failed to create config file: %w", err)
+		}
+		report.Copied["config"]++
+	}
+
+	return report, nil
+}
+
+func (t *Transfer) Close(ctx context.Context) error {
+	return errors.Join(t.dst.Close(ctx), t.src.Close(ctx))
+}
+
+// checkConfig fails if the destination holds a repository other than the
+// source.
+func (t *Transfer) checkConfig(ctx context.Context, config []byte) error {
+	rd, err := t.dst.getFile(ctx, "CONFIG")
+	if err != nil {
+		return fmt.Errorf("failed to open config file: %w", err)
+	}
+	defer rd.Close()
+
+	data, err := io.ReadAll(rd)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	if !bytes.Equal(data, config) {
+		return fmt.Errorf("%s holds another repository", t.dst.remote())
+	}
+	return nil
+}
+
+// prepare sets the layout of the destination and creates its folders. A
+// destination without objects gets the layout of its configuration, one
+// being resumed keeps the layout it was given.
+func (t *Transfer) prepare(ctx context.Context) error {
+	if err := t.dst.checkTiers(ctx); err != nil {
+		return err
+	}
+
+	if t.dst.mkdir(ctx, "") != nil {
+		return fmt.Errorf("failed to create root directory")
+	}
+
+	hasLayout, err := t.dst.exists(ctx, layoutFile)
+	if err != nil {
+		return err
+	}
+
+	entries, err := t.dst.listFolder(ctx, "")
+	if err != nil {
+		return fmt.Errorf("failed to list root folder: %w", err)
+	}
+	started := false
+	for _, entry := range entries {
+		if entry.Path == "states" || entry.Path == "packfiles" {
+			started = true
+		}
+	}
+
+	if hasLayout || started {
+		t.dst.layout, err = t.dst.readLayout(ctx)
+		if err != nil {
+			return err
+		}
+	} else {
+		t.dst.layout = t.dst.opts.layout
+		if t.dst.layout != layoutFlat {
+			_, err = t.dst.putFile(ctx, layoutFile, strings.NewReader(t.dst.layout))
+			if err != nil {
+				return fmt.Errorf("failed to create layout file: %w", err)
+			}
+		}
+	}
+
+	for _, dir := range []string{"states", "packfiles", "locks"} {
+		if err := t.dst.mkdir(ctx, dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyFolder copies the objects of dir missing on the destination.
+func (t *Transfer) copyFolder(ctx context.Context, dir string, concurrency int, report *TransferReport) error {
+	srcMacs, err := t.src.getMacs(ctx, dir)
+	if err != nil {
+		return fmt.Errorf("failed to list %s on %s: %w", dir, t.src.remote(), err)
+	}
+	dstMacs, err := t.dst.getMacs(ctx, dir)
+	if err != nil {
+		return fmt.Errorf("failed to list %s on %s: %w", dir, t.dst.remote(), err)
+	}
+
+	present := make(map[objects.MAC]struct{}, len(dstMacs))
+	for _, mac := range dstMacs {
+		present[mac] = struct{}{}
+	}
+
+	var mu sync.Mutex
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(max(concurrency, 1))
+	for _, mac := range srcMacs {
+		if _, found := present[mac]; found {
+			report.Present[dir]++
+			continue
+		}
+
+		g.Go(func() error {
+			if err := t.copyObject(ctx, dir, mac); err != nil {
+				return err
+			}
+			mu.Lock()
+			report.Copied[dir]++
+			mu.Unlock()
+			return nil
+		})
+	}
+
+	return g.Wait()
+}
+
+// copyObject copies the object mac of dir with operations/copyfile, which
+// copies server-side when both remotes allow it and streams it otherwise.
+func (t *Transfer) copyObject(ctx context.Context, dir string, mac objects.MAC) error {
+	name := t.dst.objectPath(dir, mac)
+	payload := map[string]any{
+		"srcFs":     t.src.remote(),
+		"srcRemote": t.src.objectPath(dir, mac),
+		"dstFs":     t.dst.remoteFor(name),
+		"dstRemote": name,
+	}
+
+	_, err := t.dst.opts.retry.RPC(ctx, "operations/copyfile", payload)
+	if err != nil {
+		return fmt.Errorf("failed to copy file %s: %w", name, err)
+	}
+
+	if t.dst.retention != nil {
+		return t.dst.retention.apply(ctx, name)
+	}
+	return nil
+}
+
+// verifyFolder compares the size and, when both remotes support a common
+// one, the hash of the objects of dir on both sides. Objects that don't
+// match are removed from the destination.
+func (t *Transfer) verifyFolder(ctx context.Context, dir string) ([]string, error) {
+	srcFs, err := t.src.fs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	dstFs, err := t.dst.fs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	srcObjs, err := listObjects(ctx, srcFs, dir)
+	if err != nil {
+		return nil, err
+	}
+	dstObjs, err := listObjects(ctx, dstFs, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	ht := srcFs.Hashes().Overlap(dstFs.Hashes()).GetOne()
+
+	var mismatches []string
+	for name, srcObj := range srcObjs {
+		if _, err := t.src.objectMac(dir, srcObj); err != nil {
+			continue
+		}
+
+		dstObj, found := dstObjs[name]
+		if !found {
+			mismatches = append(mismatches, fmt.Sprintf("%s: missing", srcObj.Remote()))
+			continue
+		}
+
+		problem := ""
+		if srcObj.Size() != dstObj.Size() {
+			problem = fmt.Sprintf("size %d, expected %d", dstObj.Size(), srcObj.Size())
+		} else if ht != hash.None {
+			srcSum, err := srcObj.Hash(ctx, ht)
+			if err != nil {
+				return nil, fmt.Errorf("failed to hash %s: %w", srcObj.Remote(), err)
+			}
+			dstSum, err := dstObj.Hash(ctx, ht)
+			if err != nil {
+				return nil, fmt.Errorf("failed to hash %s: %w", dstObj.Remote(), err)
+			}
+			if srcSum != "" && dstSum != "" && srcSum != dstSum {
+				problem = fmt.Sprintf("%s %s, expected %s", ht, dstSum, srcSum)
+			}
+		}
+
+		if problem != "" {
+			if err := t.dst.checkDelete(dstObj.Remote()); err != nil {
+				mismatches = append(mismatches, fmt.Sprintf("%s: %s, kept: %v", dstObj.Remote(), problem, err))
+				continue
+			}
+			if err := dstObj.Remove(ctx); err != nil {
+				return nil, fmt.Errorf("failed to remove %s: %w", dstObj.Remote(), err)
+			}
+			mismatches = append(mismatches, fmt.Sprintf("%s: %s", dstObj.Remote(), problem))
+		}
+	}
+
+	return mismatches, nil
+}
+
+// objectMac returns the MAC of obj if it is at its expected place in dir.
+func (r *RcloneStorage) objectMac(dir string, obj fs.Object) (objects.MAC, error) {
+	data, err := hex.DecodeString(path.Base(obj.Remote()))
+	if err != nil || len(data) != len(objects.MAC{}) {
+		return objects.MAC{}, fmt.Errorf("invalid object name %s", obj.Remote())
+	}
+
+	mac := objects.MAC(data)
+	if r.objectPath(dir, mac) != obj.Remote() {
+		return objects.MAC{}, fmt.Errorf("misplaced object %s", obj.Remote())
+	}
+	return mac, nil
+}
+
+// listObjects returns the objects below dir, whatever the layout, by name.
+func listObjects(ctx context.Context, f fs.Fs, dir string) (map[string]fs.Object, error) {
+	objs := make(map[string]fs.Object)
+	err := walk.ListR(ctx, f, dir, true, -1, walk.ListObjects, func(entries fs.DirEntries) error {
+		for _, entry := range entries {
+			if obj, ok := entry.(fs.Object); ok {
+				objs[path.Base(obj.Remote())] = obj
+			}
+		}
+		return nil
+	})
+	if errors.Is(err, fs.ErrorDirNotFound) {
+		return objs, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to list folder %s: %w", dir, err)
+	}
+	return objs, nil
+}
@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+func TestTransfer(t *testing.T) {
+	ctx := context.Background()
+	src, srcDir := newLocalRepository(t, nil)
+
+	var state, packfile, lock objects.MAC
+	state[0] = 1
+	packfile[0] = 2
+	lock[0] = 3
+	if _, err := src.PutState(ctx, state, strings.NewReader("state")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := src.PutPackfile(ctx, packfile, strings.NewReader("packfile")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := src.PutLock(ctx, lock, strings.NewReader("lock")); err != nil {
+		t.Fatal(err)
+	}
+	src.Close(ctx)
+
+	// a staging object of a backup in progress on the source
+	staged := filepath.Join(srcDir, stagingPath("packfiles/in-progress"))
+	if err := os.WriteFile(staged, []byte("partial"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	dstDir := filepath.Join(t.TempDir(), "dst")
+	transfer, err := NewTransfer(ctx,
+		map[string]string{"location": "rclone://" + srcDir, "type": "local", "staging_max_age": "0s"},
+		map[string]string{"location": "rclone://" + dstDir, "type": "local"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transfer.Close(ctx)
+
+	report, err := transfer.Run(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Mismatches) != 0 {
+		t.Errorf("mismatches %v", report.Mismatches)
+	}
+	for dir, expected := range map[string]int{"config": 1, "states": 1, "packfiles": 1, "locks": 0} {
+		if report.Copied[dir] != expected {
+			t.Errorf("copied %d %s, expected %d", report.Copied[dir], dir, expected)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(dstDir, layoutPath(layoutFlat, "locks", lock))); !os.IsNotExist(err) {
+		t.Error("lock copied to the destination")
+	}
+	if _, err := os.Stat(staged); err != nil {
+		t.Error("staging object removed from the source")
+	}
+
+	// running it again finds everything in place
+	report, err = transfer.Run(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Present["config"] != 1 || report.Present["packfiles"] != 1 || report.Copied["packfiles"] != 0 {
+		t.Errorf("unexpected report of a completed transfer %+v", report)
+	}
+}
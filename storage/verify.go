@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/PlakarKorp/integration-rclone/utils"
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/hash"
+)
+
+// uploadHasher returns a hasher computing one of the hashes supported by f,
+// or nil when the backend has no hash support or verification is disabled.
+func (r *RcloneStorage) uploadHasher(f fs.Fs) (*hash.MultiHasher, error) {
+	if !r.opts.verifyUploads {
+		return nil, nil
+	}
+
+	hashType := f.Hashes().GetOne()
+	if hashType == hash.None {
+		return nil, nil
+	}
+
+	hasher, err := hash.NewMultiHasherTypes(hash.NewHashSet(hashType))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s hasher: %w", hashType, err)
+	}
+	return hasher, nil
+}
+
+// verifyUpload checks that the remote object name matches the size and, if
+// a hasher is given, the hash of the data sent. A mismatching object is
+// removed from the remote, unless the store is append-only.
+func (r *RcloneStorage) verifyUpload(ctx context.Context, f fs.Fs, name string, size int64, hasher *hash.MultiHasher) error {
+	obj, err := f.NewObject(ctx, name)
+	if err != nil {
+		return fmt.Errorf("failed to stat uploaded file: %w", utils.TranslateError(r.remotePath(name), err))
+	}
+
+	if obj.Size() >= 0 && obj.Size() != size {
+		r.removeMismatch(ctx, obj)
+		return fmt.Errorf("uploaded file %s is %d bytes, expected %d", name, obj.Size(), size)
+	}
+
+	if hasher == nil {
+		return nil
+	}
+
+	for hashType, sum := range hasher.Sums() {
+		remoteSum, err := obj.Hash(ctx, hashType)
+		if err != nil {
+			return fmt.Errorf("failed to get %s of uploaded file %s: %w", hashType, name, err)
+		}
+
+		// some backends can't always tell the hash of an object, e.g. s3
+		// for multipart uploads: the size check has to do
+		if remoteSum == "" {
+			continue
+		}
+
+		if !hash.Equals(sum, remoteSum) {
+			r.removeMismatch(ctx, obj)
+			return fmt.Errorf("uploaded file %s has %s %s, expected %s", name, hashType, remoteSum, sum)
+		}
+	}
+
+	return nil
+}
+
+// removeMismatch removes the uploaded object obj that doesn't match the data
+// sent, if the mode of the store allows it.
+func (r *RcloneStorage) removeMismatch(ctx context.Context, obj fs.Object) {
+	if isContentAddressed(obj.Remote()) && r.checkDelete(obj.Remote()) != nil {
+		return
+	}
+	obj.Remove(ctx)
+}
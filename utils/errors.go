@@ -0,0 +1,141 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	iofs "io/fs"
+	"regexp"
+	"strings"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/fserrors"
+)
+
+// Errors returned by remote operations match these sentinels, or
+// io/fs.ErrNotExist and io/fs.ErrPermission, with errors.Is.
+var (
+	ErrRateLimited   = errors.New("rate limited by the provider")
+	ErrQuotaExceeded = errors.New("storage quota exceeded")
+
+	// ErrRetryable marks failures that may succeed if tried again. Rate
+	// limited operations are retryable too.
+	ErrRetryable = errors.New("temporary failure")
+)
+
+// RemoteError is a failed operation on a remote path.
+type RemoteError struct {
+	Path string
+	Err  error
+
+	kinds []error
+}
+
+func (e *RemoteError) Error() string {
+	return e.Path + ": " + e.Err.Error()
+}
+
+func (e *RemoteError) Unwrap() []error {
+	return append(append([]error{}, e.kinds...), e.Err)
+}
+
+// errorPatterns recognizes the categories of errors known to rclone only by
+// their message, such as the ones returned by librclone jobs. HTTP status
+// codes must stand alone so that they don't match within object names.
+var errorPatterns = []struct {
+	re    *regexp.Regexp
+	kinds []error
+}{
+	{
+		regexp.MustCompile(`\b429\b|rate ?limit|too many requests|slow ?down|throttl`),
+		[]error{ErrRateLimited, ErrRetryable},
+	},
+	{
+		regexp.MustCompile(`quota|\b507\b|insufficient (storage|space)|no space left|storage full`),
+		[]error{ErrQuotaExceeded},
+	},
+	{
+		regexp.MustCompile(`\b404\b|not found|no such (file|key|bucket)|nosuch(key|bucket)|does ?n[o']t exist`),
+		[]error{iofs.ErrNotExist},
+	},
+	{
+		regexp.MustCompile(`\b40[13]\b|permission denied|access ?denied|forbidden|unauthori[sz]ed|invalid_grant|token (has )?expired|invalid credentials`),
+		[]error{iofs.ErrPermission},
+	},
+	{
+		regexp.MustCompile(`\b50[0234]\b|internal ?error|service ?unavailable|bad gateway|time(d)? ?out|connection (reset|refused)|unexpected eof|broken pipe|temporar`),
+		[]error{ErrRetryable},
+	},
+}
+
+// TranslateError wraps err, returned by an operation on path, in a
+// RemoteError matching the sentinel of its category.
+func TranslateError(path string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var remoteErr *RemoteError
+	if errors.As(err, &remoteErr) {
+		return err
+	}
+
+	return &RemoteError{Path: path, Err: err, kinds: classify(path, err)}
+}
+
+func classify(path string, err error) []error {
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return nil
+	case errors.Is(err, fs.ErrorObjectNotFound), errors.Is(err, fs.ErrorDirNotFound):
+		return []error{iofs.ErrNotExist}
+	case errors.Is(err, fs.ErrorPermissionDenied):
+		return []error{iofs.ErrPermission}
+	}
+
+	message := strings.ToLower(stripPaths(err.Error(), path))
+	for _, pattern := range errorPatterns {
+		if pattern.re.MatchString(message) {
+			return pattern.kinds
+		}
+	}
+
+	if fserrors.IsRetryError(err) || fserrors.ShouldRetry(err) {
+		return []error{ErrRetryable}
+	}
+	return nil
+}
+
+// stripPaths removes from message the paths it mentions and the names of the
+// elements of path, which may list several remote paths, so that names
+// chosen by the user, e.g. a bucket named quota-reports, are not taken for
+// the cause of the error.
+func stripPaths(message, path string) string {
+	isSeparator := func(r rune) bool { return r == '/' || r == ':' || r == ' ' }
+	names := make(map[string]bool)
+	for _, name := range strings.FieldsFunc(path, isSeparator) {
+		names[name] = true
+	}
+
+	words := strings.Fields(message)
+	kept := words[:0]
+	for _, word := range words {
+		token := strings.Trim(word, "\"'`,;:()[]{}<>")
+		if strings.ContainsAny(token, "/\\") || isPathOf(token, names, isSeparator) {
+			continue
+		}
+		kept = append(kept, word)
+	}
+	return strings.Join(kept, " ")
+}
+
+// isPathOf reports whether token only holds names of the path elements,
+// e.g. the remote "s3:bucket".
+func isPathOf(token string, names map[string]bool, isSeparator func(rune) bool) bool {
+	elements := strings.FieldsFunc(token, isSeparator)
+	for _, element := range elements {
+		if !names[element] {
+			return false
+		}
+	}
+	return len(elements) != 0
+}
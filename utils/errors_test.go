@@ -0,0 +1,76 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	iofs "io/fs"
+	"testing"
+
+	"github.com/rclone/rclone/fs"
+)
+
+func TestTranslateError(t *testing.T) {
+	for _, test := range []struct {
+		path     string
+		err      error
+		expected []error
+		unwanted []error
+	}{
+		{"s3:bucket/repo/CONFIG", fs.ErrorObjectNotFound, []error{iofs.ErrNotExist}, nil},
+		{"s3:bucket/repo", fs.ErrorPermissionDenied, []error{iofs.ErrPermission}, nil},
+		{"s3:bucket/repo", errors.New("SlowDown: please reduce your request rate"), []error{ErrRateLimited, ErrRetryable}, nil},
+		{"drive:repo", errors.New("googleapi: Error 403: The user's Drive storage quota has been exceeded."), []error{ErrQuotaExceeded}, nil},
+		{"s3:bucket/repo", errors.New("AccessDenied: Access Denied status code: 403"), []error{iofs.ErrPermission}, nil},
+		{"s3:bucket/repo", errors.New("InternalError: status code: 500"), []error{ErrRetryable}, nil},
+		{"s3:bucket/repo", context.Canceled, nil, []error{ErrRetryable}},
+
+		// names chosen by the user are not taken for the cause
+		{"s3:quota-reports/repo", errors.New(`bucket "quota-reports": InternalError: status code: 500`), []error{ErrRetryable}, []error{ErrQuotaExceeded}},
+		{"s3:bucket/not-found-429", errors.New("s3:bucket/not-found-429/CONFIG: connection reset by peer"), []error{ErrRetryable}, []error{iofs.ErrNotExist, ErrRateLimited}},
+		{"local:/srv/forbidden", errors.New("open /srv/forbidden/CONFIG: no such file or directory"), []error{iofs.ErrNotExist}, []error{iofs.ErrPermission}},
+		{"src:a -> dst:quota", errors.New(`copying to "quota": timeout`), []error{ErrRetryable}, []error{ErrQuotaExceeded}},
+	} {
+		err := TranslateError(test.path, test.err)
+		for _, kind := range test.expected {
+			if !errors.Is(err, kind) {
+				t.Errorf("%s on %s: not %v", test.err, test.path, kind)
+			}
+		}
+		for _, kind := range test.unwanted {
+			if errors.Is(err, kind) {
+				t.Errorf("%s on %s: is %v", test.err, test.path, kind)
+			}
+		}
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s on %s: doesn't wrap the original error", test.err, test.path)
+		}
+	}
+}
+
+func TestTranslateErrorOnce(t *testing.T) {
+	err := TranslateError("s3:bucket", fs.ErrorObjectNotFound)
+	wrapped := fmt.Errorf("failed to stat file: %w", err)
+
+	if again := TranslateError("s3:other", wrapped); again != wrapped {
+		t.Errorf("translated error translated again: %v", again)
+	}
+	if TranslateError("s3:bucket", nil) != nil {
+		t.Error("nil error translated")
+	}
+}
+
+func TestStripPaths(t *testing.T) {
+	for _, test := range []struct {
+		message, path, expected string
+	}{
+		{`bucket "quota-x" not found`, "s3:quota-x/repo", "bucket not found"},
+		{"lstat /tmp/repo/CONFIG: permission denied", "local:/tmp/repo", "lstat permission denied"},
+		{"i/o timeout", "s3:bucket", "timeout"},
+		{"copy src:a/b to dst:c failed", "src:a/b -> dst:c", "copy to failed"},
+	} {
+		if got := stripPaths(test.message, test.path); got != test.expected {
+			t.Errorf("stripPaths(%q, %q) = %q, expected %q", test.message, test.path, got, test.expected)
+		}
+	}
+}
@@ -21,14 +21,29 @@ func CleanPlakarRcloneConf(configMap map[string]string) {
 
 func WriteRcloneConfigFile(name string, remoteMap map[string]string) (*os.File, error) {
 	file, err := createTempConf()
-	_, err = fmt.Fprintf(file, "[%s]\n", name)
 	if err != nil {
 		return nil, err
 	}
+	err = WriteRcloneConfigSection(file, name, remoteMap)
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// WriteRcloneConfigSection appends the remote name to the rclone config file.
+func WriteRcloneConfigSection(file *os.File, name string, remoteMap map[string]string) error {
+	_, err := fmt.Fprintf(file, "[%s]\n", name)
+	if err != nil {
+		return err
+	}
 	for k, v := range remoteMap {
 		_, err = fmt.Fprintf(file, "%s = %s\n", k, v)
+		if err != nil {
+			return err
+		}
 	}
-	return file, nil
+	return nil
 }
 
 func createTempConf() (*os.File, error) {
@@ -0,0 +1,204 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	iofs "io/fs"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/fserrors"
+)
+
+// retryCategories maps the names accepted by retry_on to the errors they
+// cover.
+var retryCategories = map[string]error{
+	"temporary":  ErrRetryable,
+	"rate_limit": ErrRateLimited,
+	"quota":      ErrQuotaExceeded,
+	"permission": iofs.ErrPermission,
+	"not_found":  iofs.ErrNotExist,
+}
+
+// RetryPolicy tells how remote operations are retried.
+type RetryPolicy struct {
+	// MaxAttempts is the number of times an operation is tried, 1 disabling
+	// retries.
+	MaxAttempts int
+
+	// Backoff is the delay before the first retry. It doubles on each
+	// attempt, up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	// Jitter is the fraction of the delay that is randomized, so that
+	// concurrent operations don't retry in lockstep.
+	Jitter float64
+
+	// RetryOn lists the error categories that are retried.
+	RetryOn []error
+
+	// BufferSize is how much of an upload that can't seek is kept in memory
+	// to replay it when retried. Larger uploads are only retried if Spool
+	// allows recording them to a temporary file.
+	BufferSize int64
+	Spool      bool
+}
+
+// ParseRetryPolicy removes the retry_* options from config and returns the
+// policy they describe.
+func ParseRetryPolicy(config map[string]string) (*RetryPolicy, error) {
+	p := &RetryPolicy{
+		MaxAttempts: 5,
+		Backoff:     time.Second,
+		MaxBackoff:  time.Minute,
+		Jitter:      0.2,
+		RetryOn:     []error{ErrRetryable, ErrRateLimited},
+		BufferSize:  8 << 20,
+	}
+
+	if v, ok := popConfig(config, "retry_attempts"); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid retry_attempts %q: expected a positive integer", v)
+		}
+		p.MaxAttempts = n
+	}
+
+	if v, ok := popConfig(config, "retry_backoff"); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid retry_backoff %q: expected a duration", v)
+		}
+		p.Backoff = d
+	}
+
+	if v, ok := popConfig(config, "retry_backoff_max"); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid retry_backoff_max %q: expected a duration", v)
+		}
+		p.MaxBackoff = d
+	}
+
+	if v, ok := popConfig(config, "retry_jitter"); ok {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f < 0 || f > 1 {
+			return nil, fmt.Errorf("invalid retry_jitter %q: expected a number between 0 and 1", v)
+		}
+		p.Jitter = f
+	}
+
+	if v, ok := popConfig(config, "retry_on"); ok {
+		p.RetryOn = nil
+		for _, name := range strings.Split(v, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			category, found := retryCategories[name]
+			if !found {
+				return nil, fmt.Errorf("invalid retry_on category %q: expected temporary, rate_limit, quota, permission or not_found", name)
+			}
+			p.RetryOn = append(p.RetryOn, category)
+		}
+	}
+
+	if v, ok := popConfig(config, "retry_buffer_size"); ok {
+		var size fs.SizeSuffix
+		if err := size.Set(v); err != nil || size < 0 {
+			return nil, fmt.Errorf("invalid retry_buffer_size %q: expected a size", v)
+		}
+		p.BufferSize = int64(size)
+	}
+
+	if v, ok := popConfig(config, "retry_spool"); ok {
+		spool, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid retry_spool %q: expected a boolean", v)
+		}
+		p.Spool = spool
+	}
+
+	return p, nil
+}
+
+func popConfig(config map[string]string, key string) (string, bool) {
+	v, ok := config[key]
+	if ok {
+		delete(config, key)
+	}
+	return v, ok
+}
+
+// retryable reports whether err falls in one of the retried categories.
+func (p *RetryPolicy) retryable(err error) bool {
+	for _, category := range p.RetryOn {
+		if errors.Is(err, category) {
+			return true
+		}
+	}
+	return false
+}
+
+// delay returns how long to wait before the given retry, counting from 1.
+func (p *RetryPolicy) delay(retry int, err error) time.Duration {
+	d := p.Backoff
+	for i := 1; i < retry && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	d = min(d, p.MaxBackoff)
+	d -= time.Duration(p.Jitter * rand.Float64() * float64(d))
+
+	// the provider may tell when to try again
+	if retryAfter := fserrors.RetryAfterErrorTime(err); !retryAfter.IsZero() {
+		d = max(d, time.Until(retryAfter))
+	}
+	return d
+}
+
+// Do runs fn, the operation op, until it succeeds, fails with an error that
+// is not retried or marked with fserrors.NoRetryError, or MaxAttempts is
+// reached. Retries are logged along with their count.
+func (p *RetryPolicy) Do(ctx context.Context, op string, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			if attempt > 1 {
+				fs.Logf(nil, "%s: succeeded after %d retries", op, attempt-1)
+			}
+			return nil
+		}
+
+		if attempt >= p.MaxAttempts || !p.retryable(err) || fserrors.IsNoRetryError(err) || ctx.Err() != nil {
+			if attempt > 1 {
+				return fmt.Errorf("%w (after %d retries)", err, attempt-1)
+			}
+			return err
+		}
+
+		d := p.delay(attempt, err)
+		fs.Logf(nil, "%s: attempt %d/%d failed: %v, retrying in %s", op, attempt, p.MaxAttempts, err, d.Round(time.Millisecond))
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(d):
+		}
+	}
+}
+
+// RPC calls the librclone method with payload under the policy.
+func (p *RetryPolicy) RPC(ctx context.Context, method string, payload map[string]any) (string, error) {
+	var output string
+	err := p.Do(ctx, method+" "+rpcPath(payload), func() error {
+		var err error
+		output, err = RPC(ctx, method, payload)
+		return err
+	})
+	return output, err
+}
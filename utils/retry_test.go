@@ -0,0 +1,142 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	iofs "io/fs"
+	"testing"
+	"time"
+
+	"github.com/rclone/rclone/fs/fserrors"
+)
+
+func TestParseRetryPolicy(t *testing.T) {
+	config := map[string]string{
+		"retry_attempts":    "3",
+		"retry_backoff":     "10ms",
+		"retry_backoff_max": "1s",
+		"retry_jitter":      "0",
+		"retry_on":          "quota, not_found",
+		"retry_buffer_size": "1M",
+		"retry_spool":       "true",
+		"other":             "kept",
+	}
+	p, err := ParseRetryPolicy(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p.MaxAttempts != 3 || p.Backoff != 10*time.Millisecond || p.MaxBackoff != time.Second || p.Jitter != 0 {
+		t.Errorf("unexpected policy %+v", p)
+	}
+	if len(p.RetryOn) != 2 || p.RetryOn[0] != ErrQuotaExceeded || p.RetryOn[1] != iofs.ErrNotExist {
+		t.Errorf("unexpected retried categories %v", p.RetryOn)
+	}
+	if p.BufferSize != 1<<20 || !p.Spool {
+		t.Errorf("unexpected buffer size %d and spool %v", p.BufferSize, p.Spool)
+	}
+	if len(config) != 1 || config["other"] != "kept" {
+		t.Errorf("retry options left in config: %v", config)
+	}
+}
+
+func TestParseRetryPolicyInvalid(t *testing.T) {
+	for key, value := range map[string]string{
+		"retry_attempts":    "0",
+		"retry_backoff":     "soon",
+		"retry_backoff_max": "-1s",
+		"retry_jitter":      "2",
+		"retry_on":          "everything",
+		"retry_buffer_size": "big",
+		"retry_spool":       "maybe",
+	} {
+		if _, err := ParseRetryPolicy(map[string]string{key: value}); err == nil {
+			t.Errorf("%s=%s accepted", key, value)
+		}
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := &RetryPolicy{Backoff: time.Second, MaxBackoff: 5 * time.Second}
+	err := errors.New("failed")
+
+	for retry, expected := range map[int]time.Duration{
+		1: time.Second,
+		2: 2 * time.Second,
+		3: 4 * time.Second,
+		4: 5 * time.Second,
+		9: 5 * time.Second,
+	} {
+		if d := p.delay(retry, err); d != expected {
+			t.Errorf("retry %d: delay %s, expected %s", retry, d, expected)
+		}
+	}
+
+	p.Jitter = 0.5
+	for range 100 {
+		if d := p.delay(1, err); d < 500*time.Millisecond || d > time.Second {
+			t.Fatalf("delay %s out of the jitter range", d)
+		}
+	}
+}
+
+func TestRetryPolicyDelayRetryAfter(t *testing.T) {
+	p := &RetryPolicy{Backoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	err := fserrors.NewErrorRetryAfter(time.Minute)
+
+	if d := p.delay(1, err); d < 50*time.Second {
+		t.Errorf("delay %s doesn't honour the provider's retry after", d)
+	}
+}
+
+func TestRetryPolicyDo(t *testing.T) {
+	p := &RetryPolicy{MaxAttempts: 3, RetryOn: []error{ErrRetryable}}
+	ctx := context.Background()
+
+	attempts := 0
+	err := p.Do(ctx, "test", func() error {
+		attempts++
+		if attempts < 2 {
+			return ErrRetryable
+		}
+		return nil
+	})
+	if err != nil || attempts != 2 {
+		t.Errorf("got %v after %d attempts, expected success after 2", err, attempts)
+	}
+
+	attempts = 0
+	err = p.Do(ctx, "test", func() error {
+		attempts++
+		return ErrRetryable
+	})
+	if !errors.Is(err, ErrRetryable) || attempts != 3 {
+		t.Errorf("got %v after %d attempts, expected ErrRetryable after 3", err, attempts)
+	}
+
+	for _, failure := range []error{iofs.ErrPermission, fserrors.NoRetryError(ErrRetryable)} {
+		attempts = 0
+		err = p.Do(ctx, "test", func() error {
+			attempts++
+			return failure
+		})
+		if !errors.Is(err, failure) || attempts != 1 {
+			t.Errorf("got %v after %d attempts, expected %v without retry", err, attempts, failure)
+		}
+	}
+}
+
+func TestRetryPolicyDoCancelled(t *testing.T) {
+	p := &RetryPolicy{MaxAttempts: 5, Backoff: time.Hour, MaxBackoff: time.Hour, RetryOn: []error{ErrRetryable}}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	attempts := 0
+	err := p.Do(ctx, "test", func() error {
+		attempts++
+		cancel()
+		return ErrRetryable
+	})
+	if !errors.Is(err, ErrRetryable) || attempts != 1 {
+		t.Errorf("got %v after %d attempts, expected to stop once cancelled", err, attempts)
+	}
+}
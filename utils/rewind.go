@@ -0,0 +1,134 @@
+package utils
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// ErrNotRewindable is returned by Rewind when the data read from the stream
+// was not kept.
+var ErrNotRewindable = errors.New("stream cannot be read again")
+
+// Rewinder wraps a stream so that it can be read again from the start, for
+// instance to retry an upload. Data read from the stream is recorded in
+// memory up to a limit, which is replayed after Rewind before reading on
+// from the stream. Past the limit, the data is spooled to a temporary file
+// if allowed, and stops being recorded otherwise.
+type Rewinder struct {
+	src    io.Reader
+	seeker io.Seeker
+	start  int64
+
+	limit      int64
+	allowSpool bool
+	buf        []byte
+	spool      *os.File
+	overflow   bool
+
+	pos      int64
+	recorded int64
+}
+
+// NewRewinder returns a Rewinder reading from src, recording up to limit
+// bytes in memory and spooling the rest to a temporary file if spool is set.
+// Streams that can seek are rewound without being recorded.
+func NewRewinder(src io.Reader, limit int64, spool bool) *Rewinder {
+	if seeker, ok := src.(io.Seeker); ok {
+		if start, err := seeker.Seek(0, io.SeekCurrent); err == nil {
+			return &Rewinder{src: src, seeker: seeker, start: start}
+		}
+	}
+	return &Rewinder{src: src, limit: limit, allowSpool: spool}
+}
+
+func (r *Rewinder) Read(p []byte) (int, error) {
+	if r.seeker != nil || r.overflow {
+		return r.src.Read(p)
+	}
+
+	if r.pos < r.recorded {
+		n, err := r.readRecorded(p[:min(int64(len(p)), r.recorded-r.pos)])
+		r.pos += int64(n)
+		return n, err
+	}
+
+	n, err := r.src.Read(p)
+	if n > 0 {
+		if werr := r.record(p[:n]); werr != nil {
+			return 0, werr
+		}
+	}
+	return n, err
+}
+
+func (r *Rewinder) readRecorded(p []byte) (int, error) {
+	if r.spool == nil {
+		return copy(p, r.buf[r.pos:]), nil
+	}
+	n, err := r.spool.ReadAt(p, r.pos)
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+// record keeps data, read from the stream at the end of what was recorded.
+func (r *Rewinder) record(data []byte) error {
+	if r.spool == nil && r.recorded+int64(len(data)) > r.limit {
+		if !r.allowSpool {
+			r.buf = nil
+			r.overflow = true
+			return nil
+		}
+
+		spool, err := os.CreateTemp("", "rewind-*.tmp")
+		if err != nil {
+			return err
+		}
+		r.spool = spool
+		if _, err := r.spool.WriteAt(r.buf, 0); err != nil {
+			return err
+		}
+		r.buf = nil
+	}
+
+	if r.spool != nil {
+		if _, err := r.spool.WriteAt(data, r.recorded); err != nil {
+			return err
+		}
+	} else {
+		r.buf = append(r.buf, data...)
+	}
+	r.recorded += int64(len(data))
+	r.pos = r.recorded
+	return nil
+}
+
+// CanRewind reports whether Rewind can start the stream over.
+func (r *Rewinder) CanRewind() bool {
+	return !r.overflow
+}
+
+// Rewind makes the next Read start over from the beginning of the stream.
+func (r *Rewinder) Rewind() error {
+	if r.seeker != nil {
+		_, err := r.seeker.Seek(r.start, io.SeekStart)
+		return err
+	}
+	if r.overflow {
+		return ErrNotRewindable
+	}
+	r.pos = 0
+	return nil
+}
+
+// Close removes the recorded data. It doesn't close the wrapped stream.
+func (r *Rewinder) Close() error {
+	r.buf = nil
+	if r.spool == nil {
+		return nil
+	}
+	defer os.Remove(r.spool.Name())
+	return r.spool.Close()
+}
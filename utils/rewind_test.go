@@ -0,0 +1,115 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+// stream hides the Seek method of its reader.
+type stream struct {
+	io.Reader
+}
+
+func readAll(t *testing.T, r *Rewinder) string {
+	t.Helper()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestRewinderSeeker(t *testing.T) {
+	src := strings.NewReader("0123456789")
+	src.Seek(2, io.SeekStart)
+
+	r := NewRewinder(src, 0, false)
+	defer r.Close()
+
+	if got := readAll(t, r); got != "23456789" {
+		t.Fatalf("got %q", got)
+	}
+	if err := r.Rewind(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, r); got != "23456789" {
+		t.Fatalf("got %q after rewind, expected to start over from the initial offset", got)
+	}
+}
+
+func TestRewinderMemory(t *testing.T) {
+	r := NewRewinder(stream{strings.NewReader("0123456789")}, 10, false)
+	defer r.Close()
+
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(r, head); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Rewind(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the recorded part is replayed, then the stream is read on
+	if got := readAll(t, r); got != "0123456789" {
+		t.Fatalf("got %q", got)
+	}
+	if r.spool != nil {
+		t.Error("data within the limit was spooled")
+	}
+
+	if err := r.Rewind(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, r); got != "0123456789" {
+		t.Fatalf("got %q after second rewind", got)
+	}
+}
+
+func TestRewinderOverflow(t *testing.T) {
+	r := NewRewinder(stream{strings.NewReader("0123456789")}, 4, false)
+	defer r.Close()
+
+	if got := readAll(t, r); got != "0123456789" {
+		t.Fatalf("got %q", got)
+	}
+	if r.CanRewind() {
+		t.Error("stream larger than the limit can be rewound")
+	}
+	if err := r.Rewind(); !errors.Is(err, ErrNotRewindable) {
+		t.Fatalf("rewind returned %v, expected ErrNotRewindable", err)
+	}
+	if r.spool != nil {
+		t.Error("data was spooled without being allowed to")
+	}
+}
+
+func TestRewinderSpool(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	r := NewRewinder(stream{bytes.NewReader(data)}, 100, true)
+
+	if got := readAll(t, r); got != string(data) {
+		t.Fatal("read data differs from the stream")
+	}
+	if r.spool == nil {
+		t.Fatal("data larger than the limit was not spooled")
+	}
+	spool := r.spool.Name()
+
+	if err := r.Rewind(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, r); got != string(data) {
+		t.Fatal("replayed data differs from the stream")
+	}
+
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(spool); !os.IsNotExist(err) {
+		t.Error("spool file was not removed")
+	}
+}
@@ -0,0 +1,145 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rclone/rclone/librclone/librclone"
+)
+
+// RPCError is returned by RPC when the method fails.
+type RPCError struct {
+	Method  string
+	Status  int
+	Message string
+}
+
+func (e *RPCError) Error() string {
+	return e.Message
+}
+
+// RPC calls the librclone method with payload and returns its output. The
+// call runs as an rclone job, which is stopped when ctx is done. Errors are
+// translated with TranslateError.
+func RPC(ctx context.Context, method string, payload map[string]any) (string, error) {
+	output, err := rpc(ctx, method, payload)
+	if err != nil {
+		return "", TranslateError(rpcPath(payload), err)
+	}
+	return output, nil
+}
+
+// rpcPath describes the remote paths payload operates on.
+func rpcPath(payload map[string]any) string {
+	if f, ok := payload["fs"]; ok {
+		return joinRemote(f, payload["remote"])
+	}
+	return joinRemote(payload["srcFs"], payload["srcRemote"]) + " -> " + joinRemote(payload["dstFs"], payload["dstRemote"])
+}
+
+func joinRemote(f, remote any) string {
+	fsName, _ := f.(string)
+	name, _ := remote.(string)
+	if name == "" {
+		return fsName
+	}
+	if strings.HasSuffix(fsName, ":") || strings.HasSuffix(fsName, "/") {
+		return fsName + name
+	}
+	return fsName + "/" + name
+}
+
+func rpc(ctx context.Context, method string, payload map[string]any) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	in := make(map[string]any, len(payload)+1)
+	for k, v := range payload {
+		in[k] = v
+	}
+	in["_async"] = true
+
+	var job struct {
+		JobID int64 `json:"jobid"`
+	}
+	if err := call(method, in, &job); err != nil {
+		return "", err
+	}
+
+	status, err := waitJob(ctx, job.JobID)
+	if err != nil {
+		// let the job clean up what it partially wrote before returning
+		call("job/stop", map[string]any{"jobid": job.JobID}, nil)
+		waitJob(context.Background(), job.JobID)
+		return "", err
+	}
+
+	if !status.Success {
+		return "", &RPCError{Method: method, Status: http.StatusInternalServerError, Message: status.Error}
+	}
+	if len(status.Output) == 0 || string(status.Output) == "null" {
+		return "{}", nil
+	}
+	return string(status.Output), nil
+}
+
+type jobStatus struct {
+	Finished bool            `json:"finished"`
+	Success  bool            `json:"success"`
+	Error    string          `json:"error"`
+	Output   json.RawMessage `json:"output"`
+}
+
+// waitJob polls the status of the job until it finishes or ctx is done.
+func waitJob(ctx context.Context, jobID int64) (*jobStatus, error) {
+	// jobs run in-process, so their status is cheap to poll
+	interval := 5 * time.Millisecond
+	for {
+		var status jobStatus
+		if err := call("job/status", map[string]any{"jobid": jobID}, &status); err != nil {
+			return nil, err
+		}
+		if status.Finished {
+			return &status, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(interval):
+		}
+		interval = min(2*interval, 200*time.Millisecond)
+	}
+}
+
+// call runs method synchronously and decodes its output into out.
+func call(method string, in map[string]any, out any) error {
+	input, err := json.Marshal(in)
+	if err != nil {
+		return fmt.Errorf("failed to marshal payload: %w", err)
+	}
+
+	output, status := librclone.RPC(method, string(input))
+	if status != http.StatusOK {
+		var failure struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal([]byte(output), &failure) != nil || failure.Error == "" {
+			failure.Error = output
+		}
+		return &RPCError{Method: method, Status: status, Message: failure.Error}
+	}
+
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal([]byte(output), out); err != nil {
+		return fmt.Errorf("failed to parse response: %w", err)
+	}
+	return nil
+}